@@ -0,0 +1,166 @@
+// Copyright 2021 Péter Szilágyi. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// adminQueueTimeout is the maximum time to wait for room in the alert queue when
+// sending a manual message, so the page doesn't hang on a stuck publisher.
+const adminQueueTimeout = 10 * time.Second
+
+// adminSendPage is the HTML form for manually sending messages through the
+// forwarder. It's deliberately bare bones, it's meant as an emergency tool.
+var adminSendPage = template.Must(template.New("send").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Grafana to Threema forwarder</title></head>
+<body>
+	<h1>Send a message</h1>
+	{{if .Notice}}<p><b>{{.Notice}}</b></p>{{end}}
+	<form method="POST">
+		<p>
+			<select name="to">
+				<option value="">All recipients</option>
+				{{range .Recipients}}<option value="{{.}}">{{.}}</option>{{end}}
+			</select>
+		</p>
+		<p><textarea name="message" rows="8" cols="60"></textarea></p>
+		<p><input type="submit" value="Send"></p>
+	</form>
+</body>
+</html>
+`))
+
+// newAdminHandler creates an HTTP handler that serves a tiny form for sending
+// manual messages to the configured recipients. The messages are fed into the
+// same publisher as the Grafana alerts, so they share the delivery path, being
+// rejected the same way if they can't be queued.
+func newAdminHandler(user string, secret string, tos []string, enqueue func(*http.Request, *alert) bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// Ensure the request is authorized to use the admin interface
+		if !authorized(w, req, user, secret) {
+			return
+		}
+		if req.Method == http.MethodPost && !sameOrigin(req) {
+			log.Printf("Rejecting cross origin admin request from %s", req.Header.Get("Origin"))
+			http.Error(w, "Cross origin request", http.StatusForbidden)
+			return
+		}
+		// If the form was submitted, queue up the message for publishing
+		var (
+			notice string
+			status = http.StatusOK
+		)
+
+		switch req.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			var (
+				to      = req.FormValue("to")
+				message = strings.TrimSpace(req.FormValue("message"))
+			)
+			if message == "" {
+				notice = "Cannot send an empty message"
+				break
+			}
+			var rcpts []string
+			if to != "" {
+				if !contains(tos, to) {
+					notice = "Unknown recipient: " + to
+					break
+				}
+				rcpts = []string{to}
+			}
+			log.Printf("Queueing manual message from admin interface")
+			queued := time.Now()
+			if rcpts != nil {
+				auditReceived("admin", "", "", rcpts, queued)
+			} else {
+				auditReceived("admin", "", "", tos, queued)
+			}
+			ctx, cancel := context.WithTimeout(req.Context(), adminQueueTimeout)
+			defer cancel()
+
+			if !enqueue(req.WithContext(ctx), &alert{message: message, tos: rcpts, queued: queued}) {
+				notice, status = "Publisher unavailable, message not queued", http.StatusServiceUnavailable
+				break
+			}
+			notice = "Message queued for delivery"
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(status)
+		adminSendPage.Execute(w, map[string]interface{}{
+			"Notice":     notice,
+			"Recipients": tos,
+		})
+	})
+}
+
+// newPromoteHandler creates an HTTP handler that promotes a standby forwarder to
+// an active one, starting the delivery of alerts.
+func newPromoteHandler(user string, secret string, promote func()) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !authorized(w, req, user, secret) {
+			return
+		}
+		if req.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !sameOrigin(req) {
+			log.Printf("Rejecting cross origin admin request from %s", req.Header.Get("Origin"))
+			http.Error(w, "Cross origin request", http.StatusForbidden)
+			return
+		}
+		log.Printf("Promotion requested from admin interface")
+		promote()
+		w.Write([]byte("Forwarder active\n"))
+	})
+}
+
+// sameOrigin reports whether a state changing admin request was sent from the
+// admin UI itself. Browsers resend cached basic auth credentials on cross site
+// form posts too, so the credentials alone don't prove intent (CSRF).
+//
+// The Origin (or failing that, the Referer) must match the requested host, or
+// the host forwarded by a reverse proxy, which a cross site form can't forge.
+// Requests with neither header are not browser initiated (e.g. curl) and pass.
+func sameOrigin(req *http.Request) bool {
+	source := req.Header.Get("Origin")
+	if source == "" {
+		source = req.Header.Get("Referer")
+	}
+	if source == "" {
+		return true
+	}
+	origin, err := url.Parse(source)
+	if err != nil || origin.Host == "" {
+		return false
+	}
+	return origin.Host == req.Host || origin.Host == req.Header.Get("X-Forwarded-Host")
+}
+
+// authorized checks the basic auth credentials of an admin request, rejecting
+// it if they don't match the configured ones.
+func authorized(w http.ResponseWriter, req *http.Request, user string, secret string) bool {
+	u, p, ok := req.BasicAuth()
+	if !ok || subtle.ConstantTimeCompare([]byte(u), []byte(user)) != 1 || subtle.ConstantTimeCompare([]byte(p), []byte(secret)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Basic realm="grafana-threema-forwarder"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,69 @@
+// Copyright 2021 Péter Szilágyi. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// postAdmin submits the admin send form with the given extra headers.
+func postAdmin(handler http.Handler, headers map[string]string) *httptest.ResponseRecorder {
+	form := url.Values{"message": {"hello"}}
+	req := httptest.NewRequest(http.MethodPost, "http://forwarder:8000/admin/send", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth("admin", "secret")
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+// Tests that cross origin form posts are rejected even with valid credentials,
+// while same origin and non-browser ones are queued.
+func TestAdminSameOrigin(t *testing.T) {
+	var queued []*alert
+	enqueue := func(req *http.Request, alert *alert) bool {
+		queued = append(queued, alert)
+		return true
+	}
+	handler := newAdminHandler("admin", "secret", []string{"ECHOECHO"}, enqueue)
+
+	tests := []struct {
+		headers map[string]string
+		status  int
+	}{
+		{nil, http.StatusOK},
+		{map[string]string{"Origin": "http://forwarder:8000"}, http.StatusOK},
+		{map[string]string{"Referer": "http://forwarder:8000/admin/send"}, http.StatusOK},
+		{map[string]string{"Origin": "https://proxy.example", "X-Forwarded-Host": "proxy.example"}, http.StatusOK},
+		{map[string]string{"Origin": "https://evil.example"}, http.StatusForbidden},
+		{map[string]string{"Referer": "https://evil.example/page"}, http.StatusForbidden},
+		{map[string]string{"Origin": "null"}, http.StatusForbidden},
+	}
+	for i, tt := range tests {
+		if rec := postAdmin(handler, tt.headers); rec.Code != tt.status {
+			t.Errorf("test %d: status mismatch: have %d, want %d", i, rec.Code, tt.status)
+		}
+	}
+	if len(queued) != 4 {
+		t.Errorf("queued message count mismatch: have %d, want %d", len(queued), 4)
+	}
+}
+
+// Tests that a message that can't be queued is rejected instead of hanging.
+func TestAdminUnavailable(t *testing.T) {
+	enqueue := func(req *http.Request, alert *alert) bool { return false }
+	handler := newAdminHandler("admin", "secret", []string{"ECHOECHO"}, enqueue)
+
+	if rec := postAdmin(handler, nil); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("status mismatch: have %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+}
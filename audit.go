@@ -0,0 +1,95 @@
+// Copyright 2021 Péter Szilágyi. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// auditRecord is a single self-contained line of the audit log. Received alerts
+// and delivery outcomes share the same schema, the latter referencing the alert
+// via the time it was received.
+type auditRecord struct {
+	Time       string   `json:"time"`
+	Event      string   `json:"event"` // received, delivered or failed
+	Source     string   `json:"source,omitempty"`
+	State      string   `json:"state,omitempty"`
+	Title      string   `json:"title,omitempty"`
+	Recipients []string `json:"recipients,omitempty"`
+	Received   string   `json:"received,omitempty"`
+	Attempt    int      `json:"attempt,omitempty"`
+	Error      string   `json:"error,omitempty"`
+}
+
+var (
+	auditFile *os.File   // Append-only audit log, nil if disabled
+	auditLock sync.Mutex // Lock to serialize the writes into the audit log
+)
+
+// openAudit opens the audit log for appending, creating it if it doesn't exist.
+func openAudit(path string) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	auditFile = file
+	return nil
+}
+
+// auditReceived records an alert accepted for delivery into the audit log.
+func auditReceived(source string, state string, title string, tos []string, received time.Time) {
+	writeAudit(&auditRecord{
+		Event:      "received",
+		Source:     source,
+		State:      state,
+		Title:      title,
+		Recipients: tos,
+		Received:   received.UTC().Format(time.RFC3339Nano),
+	})
+}
+
+// auditDelivery records the outcome of an alert delivery into the audit log.
+func auditDelivery(batch *delivery, err error) {
+	record := &auditRecord{
+		Event:      "delivered",
+		Recipients: []string{batch.to},
+		Received:   batch.alert.queued.UTC().Format(time.RFC3339Nano),
+		Attempt:    batch.attempts + 1,
+	}
+	if err != nil {
+		record.Event = "failed"
+		record.Error = err.Error()
+	}
+	writeAudit(record)
+}
+
+// writeAudit appends a record to the audit log as a single JSON line, syncing
+// it to disk so that it survives a crash.
+func writeAudit(record *auditRecord) {
+	if auditFile == nil {
+		return
+	}
+	record.Time = time.Now().UTC().Format(time.RFC3339Nano)
+
+	blob, err := json.Marshal(record)
+	if err != nil {
+		log.Printf("Failed to encode audit record: %v", err)
+		return
+	}
+	auditLock.Lock()
+	defer auditLock.Unlock()
+
+	if _, err := auditFile.Write(append(blob, '\n')); err != nil {
+		log.Printf("Failed to write audit record: %v", err)
+		return
+	}
+	if err := auditFile.Sync(); err != nil {
+		log.Printf("Failed to sync audit log: %v", err)
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright 2021 Péter Szilágyi. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// endpointConfig is an additional webhook endpoint with its own credentials,
+// allowing each sender (e.g. Grafana instance) to be revoked independently.
+type endpointConfig struct {
+	Path       string `mapstructure:"path" json:"path"`
+	Token      string `mapstructure:"token" json:"token,omitempty"`
+	HMACSecret string `mapstructure:"hmac-secret" json:"hmac-secret,omitempty"`
+}
+
+// MarshalJSON implements json.Marshaler, redacting the credentials so they are
+// not leaked when printing the config.
+func (c *endpointConfig) MarshalJSON() ([]byte, error) {
+	redacted := *c
+	if redacted.Token != "" {
+		redacted.Token = "<redacted>"
+	}
+	if redacted.HMACSecret != "" {
+		redacted.HMACSecret = "<redacted>"
+	}
+	type plain endpointConfig // Avoid infinite recursion
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode((*plain)(&redacted)); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSpace(buf.Bytes()), nil
+}
+
+// authenticate creates an HTTP handler that only lets through webhooks carrying
+// the given token (as a bearer token or the basic auth password) and/or the
+// HMAC-SHA256 signature of the body, keyed with the given secret, in Grafana's
+// `X-Grafana-Alerting-Signature` header. Empty credentials are not enforced.
+func authenticate(next http.HandlerFunc, token string, secret string) http.HandlerFunc {
+	if token == "" && secret == "" {
+		return next
+	}
+	return func(w http.ResponseWriter, req *http.Request) {
+		if token != "" {
+			var have string
+			if header := req.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+				have = strings.TrimPrefix(header, "Bearer ")
+			} else if _, pass, ok := req.BasicAuth(); ok {
+				have = pass
+			}
+			if subtle.ConstantTimeCompare([]byte(have), []byte(token)) != 1 {
+				log.Printf("Rejecting webhook with invalid token on %s", req.URL.Path)
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		if secret != "" {
+			body, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, maxBodyFlag))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			req.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+			mac := hmac.New(sha256.New, []byte(secret))
+			mac.Write(body)
+			want := hex.EncodeToString(mac.Sum(nil))
+
+			if !hmac.Equal([]byte(strings.ToLower(req.Header.Get("X-Grafana-Alerting-Signature"))), []byte(want)) {
+				log.Printf("Rejecting webhook with invalid signature on %s", req.URL.Path)
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		next(w, req)
+	}
+}
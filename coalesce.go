@@ -0,0 +1,40 @@
+// Copyright 2021 Péter Szilágyi. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"text/template"
+)
+
+// coalesceTemplate is the parsed expression to derive the coalescing keys of the
+// alerts with, nil if the alert fingerprints are used.
+var coalesceTemplate *template.Template
+
+// loadCoalesceKey parses a coalescing key expression, a Go template evaluated
+// over the same data as the message templates (e.g. `{{ .Labels.host }}`).
+func loadCoalesceKey(expr string) (*template.Template, error) {
+	return template.New("coalesce").Funcs(templateFuncs).Option("missingkey=zero").Parse(expr)
+}
+
+// coalesceKey derives the key identifying alerts that replace each other while
+// being held back for delivery. Without a custom expression, the fingerprint of
+// the alert is used. An empty key (e.g. a missing label) disables coalescing
+// for the given alert.
+func coalesceKey(data *messageData, fingerprint string) (string, error) {
+	if coalesceTemplate == nil {
+		return fingerprint, nil
+	}
+	var buf bytes.Buffer
+	if err := coalesceTemplate.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	key := strings.TrimSpace(buf.String())
+	if key == "<no value>" {
+		key = ""
+	}
+	return key, nil
+}
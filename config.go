@@ -0,0 +1,238 @@
+// Copyright 2021 Péter Szilágyi. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync/atomic"
+
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// fileConfig is the structured configuration that doesn't fit into CLI flags,
+// loaded from the --config file.
+type fileConfig struct {
+	Enrich     []*enrichRule      `mapstructure:"enrich" json:"enrich,omitempty"`
+	Recipients []*recipientConfig `mapstructure:"recipients" json:"recipients,omitempty"`
+	Extract    *extractConfig     `mapstructure:"extract" json:"extract,omitempty"`
+	Fields     fieldsConfig       `mapstructure:"fields" json:"fields,omitempty"`
+	Routes     []*stateRoute      `mapstructure:"routes" json:"routes,omitempty"`
+	Fallback   *fallbackRoute     `mapstructure:"fallback" json:"fallback,omitempty"`
+
+	Escalations []*escalationStep `mapstructure:"escalations" json:"escalations,omitempty"`
+	Severity    *severityConfig   `mapstructure:"severity" json:"severity,omitempty"`
+	Endpoints   []*endpointConfig `mapstructure:"endpoints" json:"endpoints,omitempty"`
+	Styles      map[string]string `mapstructure:"styles" json:"styles,omitempty"`
+}
+
+// loadedConfig is the structured configuration loaded from the config file, if
+// any. It's swapped atomically when the config is reloaded.
+var loadedConfig atomic.Pointer[fileConfig]
+
+// currentConfig retrieves the structured configuration currently in effect,
+// falling back to an empty one if no config file was loaded.
+func currentConfig() *fileConfig {
+	if conf := loadedConfig.Load(); conf != nil {
+		return conf
+	}
+	return new(fileConfig)
+}
+
+// configFormats maps the supported config file extensions to their formats.
+var configFormats = map[string]string{
+	"yaml": "yaml",
+	"yml":  "yaml",
+	"toml": "toml",
+	"json": "json",
+}
+
+// readConfig reads the structured configuration from the given file. The format
+// is selected by the file extension, unless explicitly specified.
+func readConfig(path string) (*fileConfig, error) {
+	format := configFormatFlag
+	if format == "" {
+		format = configFormats[strings.ToLower(strings.TrimPrefix(filepath.Ext(path), "."))]
+		if format == "" {
+			return nil, fmt.Errorf("unknown config format of %s, use a .yaml, .toml or .json extension or --config.format", path)
+		}
+	}
+	if _, ok := configFormats[format]; !ok {
+		return nil, fmt.Errorf("unsupported config format %q, want yaml, toml or json", format)
+	}
+	viper.SetConfigFile(path)
+	viper.SetConfigType(format)
+	if err := viper.ReadInConfig(); err != nil {
+		return nil, err
+	}
+	conf := new(fileConfig)
+	if err := viper.Unmarshal(conf); err != nil {
+		return nil, err
+	}
+	if conf.Extract != nil {
+		if err := conf.Extract.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if len(conf.Fields) > 0 {
+		if conf.Extract != nil {
+			return nil, errors.New("field renames and extraction paths are mutually exclusive")
+		}
+		if err := conf.Fields.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if err := validateStyles(conf.Styles); err != nil {
+		return nil, err
+	}
+	for _, rcpt := range conf.Recipients {
+		if rcpt.Schedule != nil {
+			if err := rcpt.Schedule.validate(); err != nil {
+				return nil, fmt.Errorf("schedule of recipient %s: %v", rcpt.ID, err)
+			}
+		}
+	}
+	return conf, nil
+}
+
+// secretFlags is the set of configuration flags whose values must never be
+// displayed, only whether they are set or not.
+var secretFlags = map[string]bool{
+	"id":                  true,
+	"id.secret":           true,
+	"admin.secret":        true,
+	"webhook.token":       true,
+	"image.render-token":  true,
+	"webhook.hmac-secret": true,
+	"new-secret":          true,
+}
+
+// urlFlags is the set of configuration flags holding URLs, which often embed
+// credentials (e.g. `user:pass@` or `?token=`) that must never be displayed.
+var urlFlags = map[string]bool{
+	"notify.webhook":  true,
+	"sink.webhook":    true,
+	"inbound.webhook": true,
+	"enrich.url":      true,
+}
+
+// redactURL masks the userinfo and the query of a URL, keeping the rest so the
+// target is still recognizable. Unparsable values are masked wholesale.
+func redactURL(value string) string {
+	u, err := url.Parse(value)
+	if err != nil {
+		return "<redacted>"
+	}
+	if u.User != nil {
+		u.User = url.User("redacted")
+	}
+	if u.RawQuery != "" {
+		u.RawQuery = "redacted"
+	}
+	return u.String()
+}
+
+// envVarPattern extracts the environment variable backing a flag from the end
+// of its usage string.
+var envVarPattern = regexp.MustCompile(`\((G2T_[A-Z0-9_]+)\)$`)
+
+// configSetting is a single resolved configuration value, along with the layer
+// it was resolved from.
+type configSetting struct {
+	Value  string `json:"value"`
+	Source string `json:"source"` // flag, env or default
+}
+
+// resolveConfig gathers the effective value of every configuration flag, along
+// with where the value originates from. Secrets and URL credentials are redacted.
+func resolveConfig(flags *pflag.FlagSet) map[string]*configSetting {
+	config := make(map[string]*configSetting)
+	flags.VisitAll(func(flag *pflag.Flag) {
+		if flag.Name == "help" || flag.Name == "config.print" {
+			return
+		}
+		setting := &configSetting{
+			Value:  flag.Value.String(),
+			Source: "default",
+		}
+		if match := envVarPattern.FindStringSubmatch(flag.Usage); match != nil {
+			if _, ok := os.LookupEnv(match[1]); ok {
+				setting.Source = "env"
+			}
+		}
+		if flag.Changed {
+			setting.Source = "flag"
+		}
+		if secretFlags[flag.Name] && setting.Value != "" {
+			setting.Value = "<redacted>"
+		}
+		if urlFlags[flag.Name] && setting.Value != "" {
+			setting.Value = redactURL(setting.Value)
+		}
+		config[flag.Name] = setting
+	})
+	return config
+}
+
+// printConfig dumps the effective configuration as JSON to stdout.
+func printConfig(flags *pflag.FlagSet) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	return enc.Encode(map[string]interface{}{
+		"flags": resolveConfig(flags),
+		"file":  currentConfig(),
+	})
+}
+
+// reloadConfig re-reads the config file and message templates, validating them
+// against the configured recipients before swapping them in. Nothing's changed
+// if any of them fail.
+func reloadConfig(tos []string) error {
+	conf := currentConfig()
+	if configFileFlag != "" {
+		var err error
+		if conf, err = readConfig(configFileFlag); err != nil {
+			return fmt.Errorf("config file: %v", err)
+		}
+		if err := validateRoutes(conf.Routes, conf.Fallback, tos); err != nil {
+			return fmt.Errorf("routes: %v", err)
+		}
+		if err := validateEscalations(conf.Escalations, tos); err != nil {
+			return fmt.Errorf("escalations: %v", err)
+		}
+	}
+	tmpl := messageTemplate.Load()
+	if formatTemplateFlag != "" {
+		var err error
+		if tmpl, err = loadTemplate(formatTemplateFlag); err != nil {
+			return fmt.Errorf("message template: %v", err)
+		}
+		if _, err := renderTemplate(tmpl, sampleMessage()); err != nil {
+			return fmt.Errorf("message template: %v", err)
+		}
+	}
+	test := testTemplate.Load()
+	if formatTestFlag != "" {
+		var err error
+		if test, err = loadTemplate(formatTestFlag); err != nil {
+			return fmt.Errorf("test template: %v", err)
+		}
+		if _, err := renderTemplate(test, sampleMessage()); err != nil {
+			return fmt.Errorf("test template: %v", err)
+		}
+	}
+	loadedConfig.Store(conf)
+	messageTemplate.Store(tmpl)
+	testTemplate.Store(test)
+	return nil
+}
@@ -0,0 +1,98 @@
+// Copyright 2021 Péter Szilágyi. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"strings"
+	"unicode/utf8"
+)
+
+// debugPayloadMaxBytes is the maximum size of a raw payload sent as a debug
+// follow-up, keeping it well within Threema's message size limit.
+const debugPayloadMaxBytes = 3000
+
+// debugPayload formats the raw webhook payload of an alert for sending it as a
+// follow-up message. The values of the redacted fields are masked at any depth
+// of the JSON document, and the result is truncated to fit into a message.
+func debugPayload(payload []byte, redact []string) string {
+	text := truncateBytes(string(redactPayload(payload, redact, "  ")), debugPayloadMaxBytes)
+	return "Raw payload:\n\n```\n" + text + "\n```"
+}
+
+// logPayload logs a raw webhook body before it's decoded, for diagnosing decode
+// failures. JSON bodies are compacted onto a single line with the redacted
+// fields masked, and the result is truncated to the given number of bytes.
+func logPayload(payload []byte, redact []string, limit int) {
+	text := string(redactPayload(payload, redact, ""))
+	if limit > 0 {
+		text = truncateBytes(text, limit)
+	}
+	log.Printf("DEBUG: Raw webhook body: %s", text)
+}
+
+// redactPayload masks the redacted fields of a JSON payload and re-encodes it
+// with the given indentation (or compacted if empty). Payloads which are not
+// JSON are returned as is.
+func redactPayload(payload []byte, redact []string, indent string) []byte {
+	var doc interface{}
+	if err := json.Unmarshal(payload, &doc); err != nil {
+		return payload
+	}
+	doc = redactFields(doc, redact)
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", indent)
+	if err := encoder.Encode(doc); err != nil {
+		return payload
+	}
+	return bytes.TrimSpace(buf.Bytes())
+}
+
+// truncateBytes cuts a text down to a maximum number of bytes, without splitting
+// a multi-byte character, marking the cut with an ellipsis. A negative limit is
+// treated as zero, leaving only the ellipsis.
+func truncateBytes(text string, limit int) string {
+	if len(text) <= limit {
+		return text
+	}
+	if limit < 0 {
+		limit = 0
+	}
+	text = text[:limit]
+	for !utf8.ValidString(text) {
+		text = text[:len(text)-1]
+	}
+	return text + "…"
+}
+
+// redactFields masks the values of the given object keys in a decoded JSON
+// document, matching the keys case insensitively.
+func redactFields(doc interface{}, redact []string) interface{} {
+	switch doc := doc.(type) {
+	case map[string]interface{}:
+		for key, value := range doc {
+			masked := false
+			for _, field := range redact {
+				if strings.EqualFold(key, field) {
+					doc[key], masked = "[redacted]", true
+					break
+				}
+			}
+			if !masked {
+				doc[key] = redactFields(value, redact)
+			}
+		}
+	case []interface{}:
+		for i, value := range doc {
+			doc[i] = redactFields(value, redact)
+		}
+	}
+	return doc
+}
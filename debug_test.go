@@ -0,0 +1,29 @@
+// Copyright 2021 Péter Szilágyi. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import "testing"
+
+// Tests that texts are truncated without splitting characters, and that limits
+// too small to fit anything don't panic.
+func TestTruncateBytes(t *testing.T) {
+	tests := []struct {
+		text  string
+		limit int
+		want  string
+	}{
+		{"hello", 10, "hello"},
+		{"hello", 5, "hello"},
+		{"hello", 3, "hel…"},
+		{"héllo", 2, "h…"},
+		{"hello", 0, "…"},
+		{"hello", -2, "…"},
+	}
+	for _, tt := range tests {
+		if have := truncateBytes(tt.text, tt.limit); have != tt.want {
+			t.Errorf("truncateBytes(%q, %d) = %q, want %q", tt.text, tt.limit, have, tt.want)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright 2021 Péter Szilágyi. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// fingerprint calculates a stable identifier for an alert rule and label set,
+// independent of the alert's current state.
+func fingerprint(alert *receivedAlert) string {
+	keys := make([]string, 0, len(alert.labels))
+	for key := range alert.labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	hasher := sha256.New()
+	fmt.Fprintf(hasher, "%d\x00%s\x00%s\x00", alert.ruleID, alert.ruleName, alert.link)
+	for _, key := range keys {
+		fmt.Fprintf(hasher, "%s=%s\x00", key, alert.labels[key])
+	}
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+// deduplicator is a bounded, resolve aware cache of recently fired alerts. A
+// firing alert is suppressed if the same fingerprint already fired within the
+// dedup window. A resolution clears the fingerprint, so a fresh fire after the
+// alert recovered is always delivered.
+type deduplicator struct {
+	window time.Duration // Time window within which repeated fires are suppressed
+	limit  int           // Maximum number of fingerprints to track
+
+	fired map[string]*list.Element // Fingerprints to their position in the eviction order
+	order *list.List               // Tracked fingerprints, oldest first
+
+	lock sync.Mutex
+}
+
+// dedupEntry is a fingerprint tracked by the deduplicator.
+type dedupEntry struct {
+	fingerprint string
+	fired       time.Time
+}
+
+// newDeduplicator creates a deduplicator suppressing repeated fires within the
+// given window, tracking at most limit fingerprints.
+func newDeduplicator(window time.Duration, limit int) *deduplicator {
+	return &deduplicator{
+		window: window,
+		limit:  limit,
+		fired:  make(map[string]*list.Element),
+		order:  list.New(),
+	}
+}
+
+// fire records a firing alert and reports whether it should be delivered or
+// suppressed as a duplicate.
+func (d *deduplicator) fire(fingerprint string, now time.Time) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if elem, ok := d.fired[fingerprint]; ok {
+		if now.Sub(elem.Value.(*dedupEntry).fired) < d.window {
+			return false
+		}
+		d.order.Remove(elem)
+		delete(d.fired, fingerprint)
+	}
+	for d.order.Len() >= d.limit {
+		oldest := d.order.Front()
+		d.order.Remove(oldest)
+		delete(d.fired, oldest.Value.(*dedupEntry).fingerprint)
+	}
+	d.fired[fingerprint] = d.order.PushBack(&dedupEntry{fingerprint: fingerprint, fired: now})
+	return true
+}
+
+// resolve clears a fingerprint after its alert recovered, so the next fire is
+// delivered regardless of the dedup window.
+func (d *deduplicator) resolve(fingerprint string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if elem, ok := d.fired[fingerprint]; ok {
+		d.order.Remove(elem)
+		delete(d.fired, fingerprint)
+	}
+}
+
+// deliver records an alert fanned out to a recipient and reports whether it
+// should be delivered or collapsed, because the recipient already got the same
+// alert in the same state within the dedup window (e.g. via overlapping routes).
+// A state change clears the previous state, so a flapping alert is delivered.
+func (d *deduplicator) deliver(to string, alert *alert, now time.Time) bool {
+	if alert.fingerprint == "" || alert.state == "" {
+		return true
+	}
+	key := to + "\x00" + alert.fingerprint + "\x00"
+	for _, state := range []string{"alerting", "ok"} {
+		if state != alert.state {
+			d.resolve(key + state)
+		}
+	}
+	return d.fire(key+alert.state, now)
+}
@@ -0,0 +1,62 @@
+// Copyright 2021 Péter Szilágyi. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// Tests that repeated fires are suppressed within the window, but a resolution
+// clears the alert so the next fire is delivered.
+func TestDeduplicatorFireResolve(t *testing.T) {
+	var (
+		dedup = newDeduplicator(time.Minute, 16)
+		now   = time.Now()
+	)
+	if !dedup.fire("disk", now) {
+		t.Fatalf("first fire suppressed")
+	}
+	if dedup.fire("disk", now.Add(time.Second)) {
+		t.Fatalf("repeated fire within window delivered")
+	}
+	dedup.resolve("disk")
+	if !dedup.fire("disk", now.Add(2*time.Second)) {
+		t.Fatalf("fire after resolution suppressed")
+	}
+	if dedup.fire("disk", now.Add(3*time.Second)) {
+		t.Fatalf("repeated fire after refire delivered")
+	}
+}
+
+// Tests that a fire is delivered again once the window elapsed.
+func TestDeduplicatorWindowExpiry(t *testing.T) {
+	var (
+		dedup = newDeduplicator(time.Minute, 16)
+		now   = time.Now()
+	)
+	dedup.fire("disk", now)
+	if !dedup.fire("disk", now.Add(time.Minute)) {
+		t.Fatalf("fire after window suppressed")
+	}
+}
+
+// Tests that the oldest fingerprints are evicted beyond the size limit.
+func TestDeduplicatorEviction(t *testing.T) {
+	var (
+		dedup = newDeduplicator(time.Minute, 2)
+		now   = time.Now()
+	)
+	dedup.fire("a", now)
+	dedup.fire("b", now)
+	dedup.fire("c", now)
+
+	if !dedup.fire("a", now) {
+		t.Fatalf("evicted fingerprint suppressed")
+	}
+	if dedup.fire("c", now) {
+		t.Fatalf("tracked fingerprint delivered")
+	}
+}
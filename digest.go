@@ -0,0 +1,132 @@
+// Copyright 2021 Péter Szilágyi. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// maxDigestLines is the number of alerts to list in a digest before the rest is
+// only counted. It keeps the digests readable during alert storms.
+const maxDigestLines = 20
+
+// digester accumulates the non-critical alerts of the recipients, summarizing
+// them periodically instead of delivering them one by one.
+type digester struct {
+	interval time.Duration           // Time to accumulate alerts for between digests
+	since    time.Time               // Start of the current digest period
+	entries  map[string]*digestEntry // Accumulated alerts, keyed by recipient
+}
+
+// digestEntry is the accumulated alerts of a single recipient.
+type digestEntry struct {
+	firing   int      // Number of firing alerts accumulated
+	resolved int      // Number of resolved alerts accumulated
+	lines    []string // Headlines of the accumulated alerts, oldest first
+	images   int      // Number of images left out of the digest
+}
+
+// newDigester creates a digester summarizing the alerts at the given interval.
+func newDigester(interval time.Duration, now time.Time) *digester {
+	return &digester{
+		interval: interval,
+		since:    now,
+		entries:  make(map[string]*digestEntry),
+	}
+}
+
+// accepts reports whether an alert should be accumulated into the digest rather
+// than delivered immediately. Only Grafana alerts are, and never critical ones.
+func (d *digester) accepts(alert *alert) bool {
+	return alert.fingerprint != "" && alert.severity != "critical"
+}
+
+// add accumulates an alert into the digest of a recipient.
+func (d *digester) add(to string, alert *alert) {
+	entry, ok := d.entries[to]
+	if !ok {
+		entry = new(digestEntry)
+		d.entries[to] = entry
+	}
+	if alert.state == "ok" {
+		entry.resolved++
+	} else {
+		entry.firing++
+	}
+	entry.images += len(alert.images)
+	entry.lines = append(entry.lines, strings.SplitN(strings.TrimSpace(alert.message), "\n", 2)[0])
+}
+
+// due returns the digests of all recipients if the interval elapsed (or if the
+// publisher is closing), clearing the accumulated alerts.
+func (d *digester) due(now time.Time, force bool) []*delivery {
+	if !force && now.Sub(d.since) < d.interval {
+		return nil
+	}
+	digests := d.flush(now)
+
+	batches := make([]*delivery, 0, len(digests))
+	for _, digest := range digests {
+		batches = append(batches, &delivery{to: digest.tos[0], alert: digest})
+	}
+	return batches
+}
+
+// flush composes the digests of all recipients with accumulated alerts, each
+// addressed explicitly to its recipient, and starts a new digest period.
+func (d *digester) flush(now time.Time) []*alert {
+	tos := make([]string, 0, len(d.entries))
+	for to := range d.entries {
+		tos = append(tos, to)
+	}
+	sort.Strings(tos)
+
+	digests := make([]*alert, 0, len(tos))
+	for _, to := range tos {
+		digests = append(digests, &alert{
+			message: formatDigest(d.entries[to], now.Sub(d.since)),
+			tos:     []string{to},
+			queued:  now,
+		})
+	}
+	d.since, d.entries = now, make(map[string]*digestEntry)
+	return digests
+}
+
+// formatDigest renders the accumulated alerts of a recipient into a summary
+// (e.g. `🗒 In the last 1h: 3 alerts, 2 resolved`), followed by their headlines.
+func formatDigest(entry *digestEntry, period time.Duration) string {
+	var counts []string
+	if entry.firing > 0 {
+		counts = append(counts, plural(entry.firing, "alert"))
+	}
+	if entry.resolved > 0 {
+		counts = append(counts, fmt.Sprintf("%d resolved", entry.resolved))
+	}
+	message := styled("title", fmt.Sprintf("🗒 In the last %s: %s", formatDuration(period), strings.Join(counts, ", "))) + "\n"
+
+	for i, line := range entry.lines {
+		if i == maxDigestLines {
+			message = message + fmt.Sprintf("\n… and %d more", len(entry.lines)-maxDigestLines)
+			break
+		}
+		message = message + "\n" + line
+	}
+	if entry.images > 0 {
+		message = message + fmt.Sprintf("\n\n%s left out", plural(entry.images, "image"))
+	}
+	return message
+}
+
+// plural renders a count with a noun, pluralized if needed (e.g. `3 alerts`).
+func plural(n int, noun string) string {
+	if n == 1 {
+		return fmt.Sprintf("%d %s", n, noun)
+	}
+	return fmt.Sprintf("%d %ss", n, noun)
+}
@@ -0,0 +1,134 @@
+// Copyright 2021 Péter Szilágyi. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+)
+
+// directoryClient creates the HTTP client to query the Threema directory with.
+//
+// The fetched pubkeys are trusted as contacts, so a forged response would let
+// anyone on the network path read every alert. The certificate of the directory
+// is thus always verified: against the configured CA bundle if one was given (to
+// pin Threema's own CA), or against the system roots otherwise.
+func directoryClient() (*http.Client, error) {
+	config := new(tls.Config)
+	if directoryCAFlag != "" {
+		blob, err := ioutil.ReadFile(directoryCAFlag)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(blob) {
+			return nil, fmt.Errorf("no certificates found in %s", directoryCAFlag)
+		}
+		config.RootCAs = pool
+	}
+	return &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: config},
+	}, nil
+}
+
+// lookupPubkey retrieves the public key associated with a Threema user based on
+// their 8 letter Threema ID.
+func lookupPubkey(id string) (string, error) {
+	client, err := directoryClient()
+	if err != nil {
+		return "", err
+	}
+	// Load the Threema user directory
+	res, err := client.Get("https://api.threema.ch/identity/" + id)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return "", errors.New(res.Status)
+	}
+	// Try to parse out the public key
+	var response struct {
+		Identity string `json:"identity"`
+		Pubkey   string `json:"publicKey"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&response); err != nil {
+		return "", err
+	}
+	if response.Identity != id {
+		return "", fmt.Errorf("response id mismatch: have %s, want %s", response.Identity, id)
+	}
+	return response.Pubkey, nil
+}
+
+// verifyPubkey checks that the public key configured for a Threema ID matches
+// the one published in the Threema directory.
+func verifyPubkey(id string, pubkey string) error {
+	remote, err := lookupPubkey(id)
+	if err != nil {
+		return err
+	}
+	have, err := base64.StdEncoding.DecodeString(pubkey)
+	if err != nil {
+		return err
+	}
+	want, err := base64.StdEncoding.DecodeString(remote)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(have, want) {
+		return fmt.Errorf("pubkey mismatch: have %s, want %s", pubkey, remote)
+	}
+	return nil
+}
+
+// checkPairing ensures that every recipient ID has a pubkey and vice versa,
+// naming the first unpaired entry. Missing (or empty) pubkeys are tolerated if
+// they are to be fetched from the Threema directory instead.
+func checkPairing(tos []string, keys []string, fetch bool) error {
+	for i, to := range tos {
+		if i < len(keys) && keys[i] != "" {
+			continue
+		}
+		if !fetch {
+			return fmt.Errorf("recipient %d (%s) has no pubkey", i, to)
+		}
+	}
+	if len(keys) > len(tos) {
+		return fmt.Errorf("pubkey %d (%s) has no recipient ID", len(tos), keys[len(tos)])
+	}
+	return nil
+}
+
+// fetchPubkeys fills in the missing pubkeys of the recipients from the Threema
+// directory, returning the complete list of keys paired with the recipients.
+func fetchPubkeys(tos []string, keys []string) ([]string, error) {
+	filled := make([]string, len(tos))
+	copy(filled, keys)
+
+	for i, to := range tos {
+		if filled[i] != "" {
+			continue
+		}
+		key, err := lookupPubkey(to)
+		if err != nil {
+			return nil, fmt.Errorf("recipient %d (%s): %v", i, to, err)
+		}
+		log.Printf("Fetched pubkey of recipient %d (%s) from the Threema directory", i, to)
+		filled[i] = key
+	}
+	return filled, nil
+}
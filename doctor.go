@@ -0,0 +1,140 @@
+// Copyright 2021 Péter Szilágyi. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// newDoctorCommand creates the `doctor` command for checking that the alerts can
+// actually reach the recipients.
+func newDoctorCommand() *cobra.Command {
+	doctorCmd := &cobra.Command{
+		Use:   "doctor",
+		Short: "Check the identity and every recipient (and optionally the Threema connection) without sending anything",
+		Run:   doctor,
+	}
+	doctorCmd.Flags().BoolVar(&doctorConnectFlag, "connect", false, "Also connect to the Threema network (drops the connection of a running forwarder with the same identity)")
+	return doctorCmd
+}
+
+// doctor goes beyond the offline validation: it loads the identity, resolves
+// every recipient in the Threema directory, checks the configured pubkeys
+// against the published ones and trusts them. If requested, it also connects to
+// the Threema network. The results are reported in a table, exiting with a non-zero
+// code if anything failed. No messages are sent.
+func doctor(cmd *cobra.Command, args []string) {
+	failed := false
+
+	// Load the identity, nothing else can be checked without it
+	id, err := loadIdentity(identityFlag, passwordFlag)
+	if err != nil {
+		fmt.Println("✗ Identity:", err)
+		os.Exit(exitIdentity)
+	}
+	fmt.Println("✓ Identity:", id.Self())
+
+	// Resolve and trust each recipient, reporting their status in a table
+	var (
+		tos  = strings.Split(recipientIDFlag, ",")
+		keys = strings.Split(recipientPubKeyFlag, ",")
+	)
+	if recipientIDFlag == "" {
+		fmt.Println("✗ Recipients: no recipient IDs provided")
+		os.Exit(exitConfig)
+	}
+	if err := checkPairing(tos, keys, true); err != nil {
+		fmt.Println("✗ Recipients:", err)
+		os.Exit(exitConfig)
+	}
+	// Collapse duplicate recipients, the identity refuses to trust a contact twice
+	for len(keys) < len(tos) {
+		keys = append(keys, "")
+	}
+	seen := make(map[string]string)
+	for i := 0; i < len(tos); i++ {
+		if key, ok := seen[tos[i]]; ok {
+			if key != keys[i] {
+				fmt.Printf("✗ Recipients: conflicting pubkeys for duplicate recipient %s\n", tos[i])
+				os.Exit(exitConfig)
+			}
+			tos = append(tos[:i], tos[i+1:]...)
+			keys = append(keys[:i], keys[i+1:]...)
+			i--
+			continue
+		}
+		seen[tos[i]] = keys[i]
+	}
+	fmt.Println()
+
+	table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "RECIPIENT\tDIRECTORY\tPUBKEY\tTRUST\t")
+	for i, to := range tos {
+		var (
+			local  = keys[i]
+			remote string
+		)
+		directory, pubkey, trust := "✓ found", "✓ matches", "✓ trusted"
+		if remote, err = lookupPubkey(to); err != nil {
+			directory, remote = "✗ "+err.Error(), ""
+		}
+		switch {
+		case remote == "" && local == "":
+			pubkey = "✗ unknown"
+		case local == "":
+			pubkey, local = "✓ from directory", remote
+		case remote == "":
+			pubkey = "? unverified"
+		case !samePubkey(local, remote):
+			pubkey = "✗ mismatch"
+		}
+		if local == "" {
+			trust = "✗ no pubkey"
+		} else if err := id.Trust(to, local); err != nil {
+			trust = "✗ " + err.Error()
+		}
+		if strings.Contains(directory+pubkey+trust, "✗") {
+			failed = true
+		}
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\t\n", to, directory, pubkey, trust)
+	}
+	table.Flush()
+	fmt.Println()
+
+	// If requested, connect to the Threema network and disconnect right away
+	if !doctorConnectFlag {
+		fmt.Println("- Threema network: skipped, enable with --connect")
+		if failed {
+			os.Exit(exitTrust)
+		}
+		return
+	}
+	start := time.Now()
+	conn, _, err := dialer(id)
+	if err != nil {
+		fmt.Println("✗ Threema network:", err)
+		os.Exit(exitRuntime)
+	}
+	conn.Close()
+	fmt.Printf("✓ Threema network: connected in %v\n", time.Since(start).Round(time.Millisecond))
+
+	if failed {
+		os.Exit(exitTrust)
+	}
+}
+
+// samePubkey reports whether two base64 encoded pubkeys are the same key.
+func samePubkey(a string, b string) bool {
+	blobA, errA := base64.StdEncoding.DecodeString(a)
+	blobB, errB := base64.StdEncoding.DecodeString(b)
+	return errA == nil && errB == nil && string(blobA) == string(blobB)
+}
@@ -0,0 +1,182 @@
+// Copyright 2021 Péter Szilágyi. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// enrichRule is a static lookup table that maps the value of an alert label to
+// some extra context (e.g. hostname to owning team) to append to the alert.
+type enrichRule struct {
+	Label  string            `mapstructure:"label" json:"label"`   // Alert label to look up
+	Name   string            `mapstructure:"name" json:"name"`     // Display name of the looked up value
+	Values map[string]string `mapstructure:"values" json:"values"` // Label value to context mapping
+}
+
+// enrichment is a single piece of extra context resolved for an alert.
+type enrichment struct {
+	Name  string
+	Value string
+}
+
+// enrich runs the alert labels through the configured lookup tables and returns
+// the extra context found. Labels without a matching lookup are skipped.
+//
+// Note, the config loader lowercases map keys, so label values are matched case
+// insensitively.
+func enrich(labels map[string]string, rules []*enrichRule) []*enrichment {
+	var extras []*enrichment
+	for _, rule := range rules {
+		value, ok := labels[rule.Label]
+		if !ok {
+			continue
+		}
+		if extra, ok := rule.Values[strings.ToLower(value)]; ok {
+			extras = append(extras, &enrichment{Name: rule.Name, Value: extra})
+		}
+	}
+	return extras
+}
+
+// maxEnrichCache is the number of label sets to cache the remote enrichments of
+// before evicting the oldest ones.
+const maxEnrichCache = 1024
+
+// remoteEnricher looks up extra context for alerts from an external HTTP service
+// (e.g. a CMDB or ownership service). The alert labels are posted as a JSON
+// object (`{"labels": {...}}`), and the fields of the JSON object in the response
+// are appended to the alert, sorted by name. Responses are cached per label set.
+type remoteEnricher struct {
+	url     string        // Endpoint to post the alert labels to
+	timeout time.Duration // Maximum time to wait for the endpoint
+	ttl     time.Duration // Time to cache a response for
+
+	cache map[string]*enrichCacheEntry // Cached responses keyed by label set hash
+	order []string                     // Cached label set hashes, oldest first
+	lock  sync.Mutex
+}
+
+// enrichCacheEntry is a cached response of the remote enrichment service.
+type enrichCacheEntry struct {
+	extras  []*enrichment
+	expires time.Time
+}
+
+// newRemoteEnricher creates an enricher posting to the given endpoint, or nil if
+// no endpoint was given.
+func newRemoteEnricher(url string, timeout time.Duration, ttl time.Duration) *remoteEnricher {
+	if url == "" {
+		return nil
+	}
+	return &remoteEnricher{
+		url:     url,
+		timeout: timeout,
+		ttl:     ttl,
+		cache:   make(map[string]*enrichCacheEntry),
+	}
+}
+
+// enrich looks up the extra context of an alert's labels, from the cache if it
+// was recently requested. Failures are returned, but the caller is expected to
+// carry on with the un-enriched alert.
+func (e *remoteEnricher) enrich(ctx context.Context, labels map[string]string) ([]*enrichment, error) {
+	if e == nil {
+		return nil, nil
+	}
+	// Hash the label set and check if it's already cached
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	hasher := sha256.New()
+	for _, key := range keys {
+		fmt.Fprintf(hasher, "%s=%s\x00", key, labels[key])
+	}
+	hash := hex.EncodeToString(hasher.Sum(nil))
+
+	e.lock.Lock()
+	if entry, ok := e.cache[hash]; ok && time.Now().Before(entry.expires) {
+		e.lock.Unlock()
+		return entry.extras, nil
+	}
+	e.lock.Unlock()
+
+	// Not cached, ask the remote service
+	extras, err := e.fetch(ctx, labels)
+	if err != nil {
+		return nil, err
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if _, ok := e.cache[hash]; !ok {
+		for len(e.order) >= maxEnrichCache {
+			delete(e.cache, e.order[0])
+			e.order = e.order[1:]
+		}
+		e.order = append(e.order, hash)
+	}
+	e.cache[hash] = &enrichCacheEntry{extras: extras, expires: time.Now().Add(e.ttl)}
+	return extras, nil
+}
+
+// fetch posts the alert labels to the remote service and converts the fields of
+// the response into enrichments. Empty and structured values are skipped.
+func (e *remoteEnricher) fetch(ctx context.Context, labels map[string]string) ([]*enrichment, error) {
+	if e.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, e.timeout)
+		defer cancel()
+	}
+	body, err := json.Marshal(map[string]interface{}{"labels": labels})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status: %s", res.Status)
+	}
+	var fields map[string]interface{}
+	if err := json.NewDecoder(res.Body).Decode(&fields); err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var extras []*enrichment
+	for _, name := range names {
+		if value := stringValue(fields[name]); value != "" {
+			extras = append(extras, &enrichment{Name: name, Value: value})
+		}
+	}
+	return extras, nil
+}
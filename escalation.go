@@ -0,0 +1,215 @@
+// Copyright 2021 Péter Szilágyi. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ackCommand matches a reply acknowledging the alerts sent to the recipient,
+// optionally only the ones with a given fingerprint (prefix).
+var ackCommand = regexp.MustCompile(`^(?i)ack(?:\s+([0-9a-f]{4,64}))?$`)
+
+// maxEscalations is the number of unacknowledged alerts to track before new ones
+// are not escalated any more. It's a safety net against alerts never acked.
+const maxEscalations = 1024
+
+// escalationStep escalates the alerts of a severity to more recipients if none
+// of the notified ones acknowledged it within some time, e.g. to page the
+// secondary on-call if the primary is unreachable.
+type escalationStep struct {
+	Severity string        `mapstructure:"severity" json:"severity,omitempty"` // Severity of the alerts to escalate, all if empty
+	After    time.Duration `mapstructure:"after" json:"after"`                 // Time to wait for an acknowledgement
+	To       []string      `mapstructure:"to" json:"to"`                       // Recipients to escalate to
+}
+
+// validateEscalations ensures that all the escalation steps wait for some time and
+// point to configured recipients, as the contacts need to be trusted up front.
+func validateEscalations(steps []*escalationStep, tos []string) error {
+	for _, step := range steps {
+		if step.After <= 0 {
+			return fmt.Errorf("escalation for severity %q has no delay", step.Severity)
+		}
+		if len(step.To) == 0 {
+			return fmt.Errorf("escalation for severity %q has no recipients", step.Severity)
+		}
+		for _, to := range step.To {
+			if !contains(tos, to) {
+				return fmt.Errorf("escalation for severity %q has unknown recipient %s", step.Severity, to)
+			}
+		}
+	}
+	return nil
+}
+
+// escalations tracks the unacknowledged alerts to escalate, nil if acknowledging
+// alerts is not enabled.
+var escalations *escalator
+
+// escalator tracks the alerts awaiting an acknowledgement from a recipient, and
+// escalates them to more recipients as their escalation steps become due. Any
+// of the notified recipients can acknowledge an alert, stopping any further
+// escalation, as does the alert resolving.
+type escalator struct {
+	pending map[string]*escalation // Unacknowledged alerts, keyed by fingerprint
+	replies chan *alert            // Confirmations to send back to the recipients
+	lock    sync.Mutex
+}
+
+// escalation is a single alert awaiting an acknowledgement.
+type escalation struct {
+	message  string            // Message of the alert to escalate
+	notified []string          // Recipients notified so far, any of which may ack
+	steps    []*escalationStep // Escalation steps not yet done
+	started  time.Time         // Time the alert was first sent
+}
+
+// newEscalator creates an escalator without any pending alerts.
+func newEscalator() *escalator {
+	return &escalator{
+		pending: make(map[string]*escalation),
+		replies: make(chan *alert, 16),
+	}
+}
+
+// track starts tracking a forwarded alert for acknowledgement if it has any
+// escalation steps configured, or stops tracking it if it resolved. Repeated
+// fires of an already tracked alert don't restart its escalation.
+func (e *escalator) track(alert *alert, tos []string, resolved bool, steps []*escalationStep) {
+	if e == nil || alert.fingerprint == "" {
+		return
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if resolved {
+		delete(e.pending, alert.fingerprint)
+		return
+	}
+	if _, ok := e.pending[alert.fingerprint]; ok {
+		return
+	}
+	var matching []*escalationStep
+	for _, step := range steps {
+		if step.Severity == "" || strings.EqualFold(step.Severity, alert.severity) {
+			matching = append(matching, step)
+		}
+	}
+	if len(matching) == 0 {
+		return
+	}
+	if len(e.pending) >= maxEscalations {
+		log.Printf("Not tracking alert for escalation, too many unacknowledged")
+		return
+	}
+	e.pending[alert.fingerprint] = &escalation{
+		message:  alert.message,
+		notified: append([]string{}, tos...),
+		steps:    matching,
+		started:  alert.queued,
+	}
+}
+
+// handle implements inboundAction, parsing acknowledgements out of the received
+// messages and confirming them to the sender. Other messages are ignored.
+func (e *escalator) handle(msg *inboundMessage) error {
+	match := ackCommand.FindStringSubmatch(strings.TrimSpace(msg.Text))
+	if match == nil {
+		return nil
+	}
+	prefix := strings.ToLower(match[1])
+
+	e.lock.Lock()
+	var acked int
+	for fingerprint, pending := range e.pending {
+		if contains(pending.notified, msg.From) && strings.HasPrefix(fingerprint, prefix) {
+			delete(e.pending, fingerprint)
+			acked++
+		}
+	}
+	e.lock.Unlock()
+
+	reply := "Nothing to acknowledge"
+	if acked > 0 {
+		log.Printf("Recipient %s acknowledged %d alerts", msg.From, acked)
+		reply = fmt.Sprintf("Acknowledged %d alerts, escalation stopped", acked)
+	}
+	select {
+	case e.replies <- &alert{message: reply, tos: []string{msg.From}, queued: time.Now()}:
+	default:
+		log.Printf("Dropping acknowledgement confirmation to %s, too many pending", msg.From)
+	}
+	return nil
+}
+
+// due collects the escalations whose next step is due, advancing them.
+func (e *escalator) due(now time.Time) []*alert {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	var escalated []*alert
+	for fingerprint, pending := range e.pending {
+		var remaining []*escalationStep
+		for _, step := range pending.steps {
+			if now.Sub(pending.started) < step.After {
+				remaining = append(remaining, step)
+				continue
+			}
+			log.Printf("Escalating alert unacknowledged for %s", formatDuration(step.After))
+			icon := "⏫"
+			if formatPlainFlag {
+				icon = "[ESCALATED]"
+			}
+			escalated = append(escalated, &alert{
+				message:     fmt.Sprintf("%s Unacknowledged for %s, escalating:\n\n%s", icon, formatDuration(step.After), pending.message),
+				tos:         step.To,
+				fingerprint: fingerprint,
+				queued:      now,
+			})
+			for _, to := range step.To {
+				if !contains(pending.notified, to) {
+					pending.notified = append(pending.notified, to)
+				}
+			}
+		}
+		pending.steps = remaining
+		if len(remaining) == 0 {
+			delete(e.pending, fingerprint) // Fully escalated, nothing left to do
+		}
+	}
+	return escalated
+}
+
+// run escalates the unacknowledged alerts and forwards the acknowledgement
+// confirmations into the publisher's alert queue until the forwarder is
+// shutting down.
+func (e *escalator) run(alerts chan *alert, quit chan struct{}) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		var queue []*alert
+		select {
+		case reply := <-e.replies:
+			queue = append(queue, reply)
+		case now := <-ticker.C:
+			queue = e.due(now)
+		case <-quit:
+			return
+		}
+		for _, alert := range queue {
+			select {
+			case alerts <- alert:
+			case <-quit:
+				return
+			}
+		}
+	}
+}
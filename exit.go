@@ -0,0 +1,28 @@
+// Copyright 2021 Péter Szilágyi. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+)
+
+// Exit codes of the startup failures, allowing supervisors to tell apart errors
+// that need an operator (bad config, broken identity) from ones that might go
+// away on a restart.
+const (
+	exitRuntime  = 1 // Any other failure, e.g. an unreadable queue file
+	exitConfig   = 2 // Invalid flags or config file
+	exitIdentity = 3 // Sender identity could not be loaded
+	exitTrust    = 4 // Recipient pubkeys could not be fetched or trusted
+	exitListen   = 5 // Webhook listener could not be opened or served
+)
+
+// fatalf is the equivalent of log.Fatalf, but exits with the given status code.
+func fatalf(code int, format string, args ...interface{}) {
+	log.Output(2, fmt.Sprintf(format, args...))
+	os.Exit(code)
+}
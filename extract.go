@@ -0,0 +1,172 @@
+// Copyright 2021 Péter Szilágyi. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// extractConfig maps the fields of an arbitrary JSON payload to the fields of a
+// Grafana event, allowing the forwarder to accept webhooks from senders with a
+// different schema.
+//
+// Each field is a dot separated path into the JSON document, with numeric path
+// segments indexing into arrays (e.g. `alerts.0.annotations.summary`).
+type extractConfig struct {
+	State    string `mapstructure:"state" json:"state,omitempty"`
+	Title    string `mapstructure:"title" json:"title,omitempty"`
+	Message  string `mapstructure:"message" json:"message,omitempty"`
+	Image    string `mapstructure:"image" json:"image,omitempty"`
+	Link     string `mapstructure:"link" json:"link,omitempty"`
+	Severity string `mapstructure:"severity" json:"severity,omitempty"`
+}
+
+// validate checks that all the configured extraction paths are well formed.
+func (c *extractConfig) validate() error {
+	for field, path := range map[string]string{
+		"state":    c.State,
+		"title":    c.Title,
+		"message":  c.Message,
+		"image":    c.Image,
+		"link":     c.Link,
+		"severity": c.Severity,
+	} {
+		if path == "" {
+			continue
+		}
+		for _, segment := range strings.Split(path, ".") {
+			if segment == "" {
+				return fmt.Errorf("invalid %s path %q: empty segment", field, path)
+			}
+		}
+	}
+	return nil
+}
+
+// extract builds a Grafana event out of an arbitrary JSON payload, using the
+// configured paths to look up the event fields. Missing fields are left empty.
+func (c *extractConfig) extract(blob []byte) (*grafanaEvent, error) {
+	var doc interface{}
+	if err := json.Unmarshal(blob, &doc); err != nil {
+		return nil, err
+	}
+	event := &grafanaEvent{
+		State:    lookupString(doc, c.State),
+		Title:    lookupString(doc, c.Title),
+		Message:  lookupString(doc, c.Message),
+		Link:     lookupString(doc, c.Link),
+		Severity: lookupString(doc, c.Severity),
+	}
+	// Images are special as they may be given as a list
+	if c.Image != "" {
+		switch image := lookupPath(doc, c.Image).(type) {
+		case string:
+			event.Image = image
+		case []interface{}:
+			for _, item := range image {
+				if url, ok := item.(string); ok {
+					event.Images = append(event.Images, url)
+				}
+			}
+		}
+	}
+	return event, nil
+}
+
+// lookupPath resolves a dot separated path in a decoded JSON document, returning
+// nil if the path does not exist.
+func lookupPath(doc interface{}, path string) interface{} {
+	for _, segment := range strings.Split(path, ".") {
+		switch node := doc.(type) {
+		case map[string]interface{}:
+			doc = node[segment]
+		case []interface{}:
+			index, err := strconv.Atoi(segment)
+			if err != nil || index < 0 || index >= len(node) {
+				return nil
+			}
+			doc = node[index]
+		default:
+			return nil
+		}
+	}
+	return doc
+}
+
+// lookupString resolves a dot separated path in a decoded JSON document and
+// converts the value into a string. Missing paths and objects are returned as
+// the empty string.
+func lookupString(doc interface{}, path string) string {
+	if path == "" {
+		return ""
+	}
+	return stringValue(lookupPath(doc, path))
+}
+
+// stringValue converts a decoded JSON value into a string. Missing values and
+// objects are returned as the empty string.
+func stringValue(value interface{}) string {
+	switch value := value.(type) {
+	case nil, map[string]interface{}, []interface{}:
+		return ""
+	case string:
+		return value
+	default:
+		return fmt.Sprint(value)
+	}
+}
+
+// fieldsConfig maps the fields of a Grafana event to the top level field names
+// of an arbitrary JSON payload (e.g. `title: summary`). It's a simpler take on
+// the extraction paths for senders that merely name their fields differently:
+// the names are taken literally, dots and all.
+type fieldsConfig map[string]string
+
+// validate checks that only known event fields are renamed.
+func (f fieldsConfig) validate() error {
+	for field, name := range f {
+		switch field {
+		case "state", "title", "message", "image", "link", "severity":
+		default:
+			return fmt.Errorf("unknown renamed field %q, want state, title, message, image, link or severity", field)
+		}
+		if name == "" {
+			return fmt.Errorf("empty name for renamed field %s", field)
+		}
+	}
+	return nil
+}
+
+// extract builds a Grafana event out of an arbitrary JSON object, looking up the
+// event fields by their configured top level names. Missing fields are left
+// empty.
+func (f fieldsConfig) extract(blob []byte) (*grafanaEvent, error) {
+	var doc map[string]interface{}
+	if err := json.Unmarshal(blob, &doc); err != nil {
+		return nil, err
+	}
+	event := &grafanaEvent{
+		State:    stringValue(doc[f["state"]]),
+		Title:    stringValue(doc[f["title"]]),
+		Message:  stringValue(doc[f["message"]]),
+		Link:     stringValue(doc[f["link"]]),
+		Severity: stringValue(doc[f["severity"]]),
+	}
+	// Images are special as they may be given as a list
+	switch image := doc[f["image"]].(type) {
+	case string:
+		event.Image = image
+	case []interface{}:
+		for _, item := range image {
+			if url, ok := item.(string); ok {
+				event.Images = append(event.Images, url)
+			}
+		}
+	}
+	return event, nil
+}
@@ -0,0 +1,402 @@
+// Copyright 2021 Péter Szilágyi. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata" // Alpine containers don't ship timezone data
+)
+
+// timeFormatPresets are the named time layouts accepted in place of a custom Go
+// reference layout.
+var timeFormatPresets = map[string]string{
+	"rfc3339":  time.RFC3339,
+	"rfc1123":  time.RFC1123,
+	"rfc822":   time.RFC822,
+	"kitchen":  time.Kitchen,
+	"stamp":    time.Stamp,
+	"datetime": "2006-01-02 15:04:05",
+}
+
+var (
+	timeLocation = time.UTC              // Timezone to render times in
+	timeLayout   = "2006-01-02 15:04:05" // Layout to render times with
+)
+
+// configureTime sets the timezone and layout to render times with. The layout
+// is either one of the named presets, or a Go reference time layout.
+func configureTime(zone string, format string) error {
+	loc, err := time.LoadLocation(zone)
+	if err != nil {
+		return err
+	}
+	timeLocation = loc
+
+	if layout, ok := timeFormatPresets[format]; ok {
+		timeLayout = layout
+	} else {
+		timeLayout = format
+	}
+	return nil
+}
+
+// formatTime renders a timestamp in the configured timezone and layout.
+func formatTime(t time.Time) string {
+	return t.In(timeLocation).Format(timeLayout)
+}
+
+// formatDuration renders a duration in a compact human readable form, keeping
+// only the two most significant units (e.g. 3d4h, 2h15m, 45s).
+func formatDuration(d time.Duration) string {
+	if d < time.Second {
+		return "0s"
+	}
+	var (
+		days  = int(d / (24 * time.Hour))
+		hours = int(d/time.Hour) % 24
+		mins  = int(d/time.Minute) % 60
+		secs  = int(d/time.Second) % 60
+	)
+	switch {
+	case days > 0 && hours > 0:
+		return fmt.Sprintf("%dd%dh", days, hours)
+	case days > 0:
+		return fmt.Sprintf("%dd", days)
+	case hours > 0 && mins > 0:
+		return fmt.Sprintf("%dh%dm", hours, mins)
+	case hours > 0:
+		return fmt.Sprintf("%dh", hours)
+	case mins > 0 && secs > 0:
+		return fmt.Sprintf("%dm%ds", mins, secs)
+	case mins > 0:
+		return fmt.Sprintf("%dm", mins)
+	default:
+		return fmt.Sprintf("%ds", secs)
+	}
+}
+
+// messageData is all the information about an alert available for rendering
+// the Threema message, either by the built-in formatter or a custom template.
+type messageData struct {
+	State       string            // Raw state of the alert (e.g. alerting, ok)
+	Icon        string            // Icon representing the alert state
+	Tag         string            // Incident tag of the alert, if tracked
+	Title       string            // Title of the alert, without the state prefix
+	Message     string            // Free form message body of the alert
+	Matches     []*matchData      // Evaluated metrics that triggered the alert
+	Extras      []*enrichment     // Extra context looked up from the labels
+	Link        string            // Link to the alert rule
+	Labels      map[string]string // Labels (tags) attached to the alert
+	ImageErrors []string          // Failures encountered while attaching images
+	Fingerprint string            // Stable identifier of the alert rule and labels
+}
+
+// matchData is a single evaluated metric that triggered an alert.
+type matchData struct {
+	Metric string
+	Value  float64
+}
+
+// formatMessage renders an alert into a Threema message, using the custom
+// template if one was configured, or the built-in format otherwise.
+func formatMessage(data *messageData) string {
+	if tmpl := messageTemplate.Load(); tmpl != nil {
+		message, err := renderTemplate(tmpl, data)
+		if err == nil {
+			return message
+		}
+		log.Printf("Failed to render message template: %v", err)
+	}
+	if formatCompactFlag {
+		return formatCompact(data)
+	}
+	message := styled("title", data.Icon+" "+data.Tag+data.Title) + "\n\n"
+	for _, err := range data.ImageErrors {
+		message = message + "Failed to attach image: " + err + "\n"
+	}
+	if len(data.ImageErrors) > 0 {
+		message = message + "\n"
+	}
+	message = message + styled("message", data.Message) + "\n\n"
+
+	switch {
+	case len(data.Matches) == 0 || formatMatchesFlag == "none":
+	case formatMatchesFlag == "summary" && len(data.Matches) > 1:
+		message = message + summarizeMatches(data.Matches) + "\n\n"
+	default:
+		for _, item := range data.Matches {
+			message = message + fmt.Sprintf("%s: %s\n", styled("metric", item.Metric), styled("value", formatNumber(item.Value, formatNumberFlag)))
+		}
+		message = message + "\n"
+	}
+	for _, extra := range data.Extras {
+		message = message + fmt.Sprintf("%s: %s\n", styled("extra", extra.Name), styled("extra-value", extra.Value))
+	}
+	if len(data.Extras) > 0 {
+		message = message + "\n"
+	}
+	return message + styled("link", data.Link)
+}
+
+// formatTest renders a test notification (e.g. sent via the "Test" button of
+// Grafana's notification channels), using the custom test template if one was
+// configured, or a built-in format making it obvious it's not a real alert.
+func formatTest(data *messageData) string {
+	if tmpl := testTemplate.Load(); tmpl != nil {
+		message, err := renderTemplate(tmpl, data)
+		if err == nil {
+			return message
+		}
+		log.Printf("Failed to render test template: %v", err)
+	}
+	message := styled("title", "🧪 Test notification from Grafana") + "\n\n"
+	if data.Message != "" {
+		message = message + styled("message", data.Message) + "\n\n"
+	}
+	return message + styled("link", data.Link)
+}
+
+// fitMessage renders an alert into a Threema message within a byte budget (zero
+// meaning unlimited). Oversized messages are trimmed by priority, the least
+// important parts first: the evaluated metrics (from the last one), the image
+// errors and enrichments, the message body and finally the link. The title and
+// state are kept, only cut short if there's nothing else left to trim.
+func fitMessage(data *messageData, budget int) string {
+	message := formatMessage(data)
+	if budget <= 0 || len(message) <= budget {
+		return message
+	}
+	trimmed := *data
+	for len(trimmed.Matches) > 0 {
+		trimmed.Matches = trimmed.Matches[:len(trimmed.Matches)-1]
+		if message = formatMessage(&trimmed); len(message) <= budget {
+			return message
+		}
+	}
+	trimmed.ImageErrors, trimmed.Extras = nil, nil
+	if message = formatMessage(&trimmed); len(message) <= budget {
+		return message
+	}
+	if trimmed.Message != "" {
+		// Try cutting the body by the overflow first, dropping it if that's not enough
+		if keep := len(trimmed.Message) - (len(message) - budget) - len("…"); keep > 0 {
+			trimmed.Message = truncateBytes(trimmed.Message, keep)
+			if message = formatMessage(&trimmed); len(message) <= budget {
+				return message
+			}
+		}
+		trimmed.Message = ""
+		if message = formatMessage(&trimmed); len(message) <= budget {
+			return message
+		}
+	}
+	trimmed.Link = ""
+	if message = formatMessage(&trimmed); len(message) <= budget {
+		return message
+	}
+	return truncateBytes(message, budget-len("…"))
+}
+
+// formatCompact renders an alert into a single line, for glanceable messages of
+// high frequency alerts (e.g. `🔥 HighCPU: node-3 92`). The details are the
+// evaluated metrics if any, or the first line of the message otherwise.
+func formatCompact(data *messageData) string {
+	line := data.Icon + " " + data.Tag + data.Title
+
+	var details []string
+	switch {
+	case formatMatchesFlag == "none":
+	case formatMatchesFlag == "summary" && len(data.Matches) > 1:
+		details = append(details, summarizeMatches(data.Matches))
+	default:
+		for _, item := range data.Matches {
+			value := strconv.FormatFloat(item.Value, 'f', -1, 64)
+			if formatNumberFlag != "fixed" {
+				value = formatNumber(item.Value, formatNumberFlag)
+			}
+			details = append(details, item.Metric+" "+value)
+		}
+	}
+	if len(details) == 0 && data.Message != "" {
+		details = append(details, strings.SplitN(strings.TrimSpace(data.Message), "\n", 2)[0])
+	}
+	if len(details) > 0 {
+		line = line + ": " + strings.Join(details, ", ")
+	}
+	return line
+}
+
+// summarizeMatches collapses the evaluated metrics of an alert into a single line
+// with their count and value range (e.g. `5 series matched (min 12.00, max 98.00)`).
+func summarizeMatches(matches []*matchData) string {
+	low, high := matches[0].Value, matches[0].Value
+	for _, item := range matches[1:] {
+		if item.Value < low {
+			low = item.Value
+		}
+		if item.Value > high {
+			high = item.Value
+		}
+	}
+	return fmt.Sprintf("%d series matched (min %s, max %s)", len(matches),
+		styled("value", formatNumber(low, formatNumberFlag)), styled("value", formatNumber(high, formatNumberFlag)))
+}
+
+// siPrefixes are the metric prefixes to humanize large values with, and
+// siFractions the ones to humanize small values with.
+var (
+	siPrefixes  = []string{"", "k", "M", "G", "T", "P", "E"}
+	siFractions = []string{"", "m", "µ", "n", "p"}
+)
+
+// bytePrefixes are the binary prefixes to humanize byte sizes with.
+var bytePrefixes = []string{"B", "KiB", "MiB", "GiB", "TiB", "PiB", "EiB"}
+
+// checkNumberFormat validates a number format, which is either a preset (fixed,
+// auto, si or bytes) or a custom printf verb for a float (e.g. `%.3f`).
+func checkNumberFormat(format string) error {
+	switch format {
+	case "fixed", "auto", "si", "bytes":
+		return nil
+	}
+	if !strings.Contains(format, "%") {
+		return fmt.Errorf("unknown number format %q", format)
+	}
+	if out := fmt.Sprintf(format, 1.0); strings.Contains(out, "%!") {
+		return fmt.Errorf("invalid number verb %q: %s", format, out)
+	}
+	return nil
+}
+
+// formatNumber renders an evaluated metric value: `fixed` with two decimals,
+// `auto` dropping the trailing zeros (keeping a few significant digits of tiny
+// values), `si` with metric prefixes (e.g. `1.5M`), `bytes` with binary prefixes
+// (e.g. `1.5GiB`) or with a custom printf verb otherwise.
+func formatNumber(value float64, format string) string {
+	switch format {
+	case "fixed":
+		return fmt.Sprintf("%.2f", value)
+	case "auto":
+		return formatAuto(value)
+	case "si":
+		abs, unit := math.Abs(value), 0
+		switch {
+		case abs >= 1:
+			for abs >= 1000 && unit < len(siPrefixes)-1 {
+				abs, value, unit = abs/1000, value/1000, unit+1
+			}
+			return formatAuto(value) + siPrefixes[unit]
+		case abs > 0:
+			for abs < 1 && unit < len(siFractions)-1 {
+				abs, value, unit = abs*1000, value*1000, unit+1
+			}
+			return formatAuto(value) + siFractions[unit]
+		}
+		return "0"
+	case "bytes":
+		abs, unit := math.Abs(value), 0
+		for abs >= 1024 && unit < len(bytePrefixes)-1 {
+			abs, value, unit = abs/1024, value/1024, unit+1
+		}
+		return formatAuto(value) + bytePrefixes[unit]
+	default:
+		return fmt.Sprintf(format, value)
+	}
+}
+
+// formatAuto renders a number with at most two decimals and no trailing zeros,
+// keeping three significant digits of values too small for that (e.g. `0.00312`).
+func formatAuto(value float64) string {
+	if value != 0 && math.Abs(value) < 0.01 {
+		return strconv.FormatFloat(value, 'g', 3, 64)
+	}
+	return strconv.FormatFloat(math.Round(value*100)/100, 'f', -1, 64)
+}
+
+// statePrefixPattern matches the bracketed state text Grafana prepends to the
+// alert titles (e.g. `[Alerting]`, `[OK]`, or any localized variant).
+var statePrefixPattern = regexp.MustCompile(`^\s*\[[^\]]*\]\s*`)
+
+// stripStatePrefix removes the leading bracketed state text from an alert title,
+// since the state icon already conveys the same information.
+func stripStatePrefix(title string) string {
+	return statePrefixPattern.ReplaceAllString(title, "")
+}
+
+// markdownLinkPattern matches a well formed markdown link, `[text](url)`. Links
+// with nested brackets or spaces in the URL are not matched, and are thus left
+// untouched instead of being mangled.
+var markdownLinkPattern = regexp.MustCompile(`\[([^\[\]]*)\]\(([^()\s]+)\)`)
+
+// convertLinks rewrites the markdown links in a text, which Threema doesn't
+// render, into something usable: `text (url)` inline, or only the url. Links
+// whose text is the url itself (or missing) are always reduced to the url.
+func convertLinks(text string, mode string) string {
+	if mode == "keep" {
+		return text
+	}
+	return markdownLinkPattern.ReplaceAllStringFunc(text, func(link string) string {
+		match := markdownLinkPattern.FindStringSubmatch(link)
+		label, url := strings.TrimSpace(match[1]), match[2]
+		if mode == "url" || label == "" || label == url {
+			return url
+		}
+		return label + " (" + url + ")"
+	})
+}
+
+// fieldStyles are the markdown styles the built-in format applies to the fields
+// of the alerts by default, overridable in the config file.
+var fieldStyles = map[string]string{
+	"title":       "bold",
+	"message":     "none",
+	"metric":      "bold",
+	"value":       "italic",
+	"extra":       "bold",
+	"extra-value": "none",
+	"link":        "none",
+}
+
+// styleMarkers are the Threema markdown markers of the supported styles. There
+// is no code style, Threema doesn't support monospace markup.
+var styleMarkers = map[string]string{
+	"bold":          "*",
+	"italic":        "_",
+	"strikethrough": "~",
+	"none":          "",
+}
+
+// validateStyles ensures that the styles configured for the fields are known.
+func validateStyles(styles map[string]string) error {
+	for field, style := range styles {
+		if _, ok := fieldStyles[field]; !ok {
+			return fmt.Errorf("unknown styled field %q", field)
+		}
+		if _, ok := styleMarkers[style]; !ok {
+			return fmt.Errorf("unknown style %q for field %s, want bold, italic, strikethrough or none", style, field)
+		}
+	}
+	return nil
+}
+
+// styled emphasizes a field of an alert with Threema's markdown according to its
+// configured style, unless plain text messages were requested.
+func styled(field string, text string) string {
+	if formatPlainFlag || text == "" {
+		return text
+	}
+	style := fieldStyles[field]
+	if custom, ok := currentConfig().Styles[field]; ok {
+		style = custom
+	}
+	marker := styleMarkers[style]
+	return marker + text + marker
+}
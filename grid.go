@@ -0,0 +1,59 @@
+// Copyright 2021 Péter Szilágyi. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"math"
+)
+
+// composeGrid lays out multiple images into a single near-square grid, so that a
+// batch of alerts can be sent as one picture instead of many. Every cell is as
+// large as the largest image, smaller ones are centered within their cells.
+func composeGrid(images [][]byte) ([]byte, error) {
+	var (
+		decoded = make([]image.Image, 0, len(images))
+		cellW   int
+		cellH   int
+	)
+	for i, blob := range images {
+		img, _, err := image.Decode(bytes.NewReader(blob))
+		if err != nil {
+			return nil, fmt.Errorf("image %d: %v", i, err)
+		}
+		if size := img.Bounds().Size(); size.X > cellW {
+			cellW = size.X
+		}
+		if size := img.Bounds().Size(); size.Y > cellH {
+			cellH = size.Y
+		}
+		decoded = append(decoded, img)
+	}
+	var (
+		cols = int(math.Ceil(math.Sqrt(float64(len(decoded)))))
+		rows = (len(decoded) + cols - 1) / cols
+		grid = image.NewRGBA(image.Rect(0, 0, cols*cellW, rows*cellH))
+	)
+	draw.Draw(grid, grid.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	for i, img := range decoded {
+		var (
+			size   = img.Bounds().Size()
+			corner = image.Pt((i%cols)*cellW+(cellW-size.X)/2, (i/cols)*cellH+(cellH-size.Y)/2)
+		)
+		draw.Draw(grid, image.Rectangle{Min: corner, Max: corner.Add(size)}, img, img.Bounds().Min, draw.Over)
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, grid); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
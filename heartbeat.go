@@ -0,0 +1,44 @@
+// Copyright 2021 Péter Szilágyi. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// alertsForwarded is the number of alerts queued for delivery since the last
+// heartbeat was sent.
+var alertsForwarded uint64
+
+// heartbeat is an indefinite goroutine that periodically sends a message to the
+// designated recipients, proving that the whole pipeline (identity, connection,
+// recipient trust) is still functioning even if there are no alerts.
+func heartbeat(interval time.Duration, tos []string, alerts chan *alert, quit chan struct{}) {
+	var (
+		started = time.Now()
+		ticker  = time.NewTicker(interval)
+	)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+		}
+		count := atomic.SwapUint64(&alertsForwarded, 0)
+		message := fmt.Sprintf("Forwarder OK, %d alerts in %s, uptime %s", count, formatDuration(interval), formatDuration(time.Since(started)))
+
+		log.Printf("Queueing heartbeat message")
+		select {
+		case alerts <- &alert{message: message, tos: tos, queued: time.Now()}:
+		case <-quit:
+			return
+		}
+	}
+}
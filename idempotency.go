@@ -0,0 +1,165 @@
+// Copyright 2021 Péter Szilágyi. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxIdempotencyKeys is the number of processed webhooks to remember for replay
+// before forgetting the old ones.
+const maxIdempotencyKeys = 1024
+
+// idempotencyReplays is the number of webhooks answered from the idempotency
+// cache instead of being processed again.
+var idempotencyReplays uint64
+
+// idempotencyCache is a bounded cache of recently processed webhook responses,
+// keyed by the X-Idempotency-Key header or by the hash of the request body. A
+// webhook retried by the sender after a timeout is answered from the cache,
+// without sending its alert again. Unlike deduplication, this operates on the
+// HTTP request level, not on the alert level.
+type idempotencyCache struct {
+	window time.Duration // Time window within which a processed request is replayed
+	limit  int           // Maximum number of responses to cache
+
+	cached map[string]*list.Element // Keys to their position in the eviction order
+	order  *list.List               // Cached responses, oldest first
+
+	lock sync.Mutex
+}
+
+// idempotencyEntry is a cached response of a processed webhook.
+type idempotencyEntry struct {
+	key    string
+	status int
+	header http.Header
+	body   []byte
+	stored time.Time
+}
+
+// newIdempotencyCache creates a cache replaying responses within the given
+// window, tracking at most limit requests.
+func newIdempotencyCache(window time.Duration, limit int) *idempotencyCache {
+	return &idempotencyCache{
+		window: window,
+		limit:  limit,
+		cached: make(map[string]*list.Element),
+		order:  list.New(),
+	}
+}
+
+// lookup retrieves the cached response of a request, if it's still fresh.
+func (c *idempotencyCache) lookup(key string, now time.Time) *idempotencyEntry {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	elem, ok := c.cached[key]
+	if !ok {
+		return nil
+	}
+	if entry := elem.Value.(*idempotencyEntry); now.Sub(entry.stored) < c.window {
+		return entry
+	}
+	c.order.Remove(elem)
+	delete(c.cached, key)
+	return nil
+}
+
+// store caches the response of a processed request, evicting the oldest ones
+// if the cache is full.
+func (c *idempotencyCache) store(entry *idempotencyEntry) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if elem, ok := c.cached[entry.key]; ok {
+		c.order.Remove(elem)
+	}
+	for c.order.Len() >= c.limit {
+		oldest := c.order.Front()
+		c.order.Remove(oldest)
+		delete(c.cached, oldest.Value.(*idempotencyEntry).key)
+	}
+	c.cached[entry.key] = c.order.PushBack(entry)
+}
+
+// wrap creates an HTTP handler that replays the cached response of already
+// processed requests, and caches the successful responses of new ones. Failed
+// requests are not cached, so the sender may retry them. A nil cache disables
+// the replay.
+func (c *idempotencyCache) wrap(next http.HandlerFunc) http.HandlerFunc {
+	if c == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, req *http.Request) {
+		key := req.Header.Get("X-Idempotency-Key")
+		if key == "" {
+			body, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, maxBodyFlag))
+			if err != nil {
+				status := http.StatusBadRequest
+				if tooLarge := new(http.MaxBytesError); errors.As(err, &tooLarge) {
+					status = http.StatusRequestEntityTooLarge
+				}
+				http.Error(w, err.Error(), status)
+				return
+			}
+			req.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+			hash := sha256.Sum256(body)
+			key = hex.EncodeToString(hash[:])
+		}
+		if entry := c.lookup(key, time.Now()); entry != nil {
+			log.Printf("Replaying response of already processed webhook (%d replays)", atomic.AddUint64(&idempotencyReplays, 1))
+			for name, values := range entry.header {
+				w.Header()[name] = values
+			}
+			w.WriteHeader(entry.status)
+			w.Write(entry.body)
+			return
+		}
+		recorder := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		next(recorder, req)
+
+		if recorder.status >= 200 && recorder.status < 300 {
+			c.store(&idempotencyEntry{
+				key:    key,
+				status: recorder.status,
+				header: w.Header().Clone(),
+				body:   recorder.body.Bytes(),
+				stored: time.Now(),
+			})
+		}
+	}
+}
+
+// responseRecorder is an HTTP response writer that passes the response through,
+// whilst also recording it to be cached.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+// WriteHeader records the status code and forwards it to the wrapped writer.
+func (r *responseRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Write records the body chunk and forwards it to the wrapped writer.
+func (r *responseRecorder) Write(blob []byte) (int, error) {
+	r.body.Write(blob)
+	return r.ResponseWriter.Write(blob)
+}
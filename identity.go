@@ -0,0 +1,93 @@
+// Copyright 2021 Péter Szilágyi. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/karalabe/go-threema"
+	"github.com/spf13/cobra"
+)
+
+// newIdentityCommand creates the `identity` command group for inspecting and
+// re-encrypting the configured Threema identity.
+func newIdentityCommand() *cobra.Command {
+	identityCmd := &cobra.Command{
+		Use:   "identity",
+		Short: "Manage the configured Threema identity",
+	}
+	identityCmd.AddCommand(&cobra.Command{
+		Use:   "info",
+		Short: "Print the Threema ID and public key of the identity",
+		Run:   identityInfo,
+	})
+	exportCmd := &cobra.Command{
+		Use:   "export",
+		Short: "Re-encrypt the identity with a new password",
+		Run:   identityExport,
+	}
+	exportCmd.Flags().StringVar(&newPasswordFlag, "new-secret", "", "New password to encrypt the exported identity with")
+	identityCmd.AddCommand(exportCmd)
+
+	return identityCmd
+}
+
+// loadIdentity decrypts an exported Threema identity. Every command decrypts it
+// exactly once, and each call returns a fresh identity, since the contacts added
+// via Trust accumulate in it and can't be added twice.
+func loadIdentity(backup string, secret string) (*threema.Identity, error) {
+	return threema.Identify(backup, secret)
+}
+
+// identityInfo loads the configured identity and prints its Threema ID and the
+// public key, which can be shared with contacts. The private key is never shown.
+func identityInfo(cmd *cobra.Command, args []string) {
+	id, err := loadIdentity(identityFlag, passwordFlag)
+	if err != nil {
+		fatalf(exitIdentity, "Failed to load identity: %v", err)
+	}
+	pubkey, err := identityPubkey(id)
+	if err != nil {
+		fatalf(exitIdentity, "Failed to derive public key: %v", err)
+	}
+	fmt.Printf("Threema ID: %s\n", id.Self())
+	fmt.Printf("Public key: %s\n", pubkey)
+}
+
+// identityExport loads the configured identity and prints it re-encrypted with
+// a new password.
+func identityExport(cmd *cobra.Command, args []string) {
+	if newPasswordFlag == "" {
+		fatalf(exitConfig, "No new password provided")
+	}
+	id, err := loadIdentity(identityFlag, passwordFlag)
+	if err != nil {
+		fatalf(exitIdentity, "Failed to load identity: %v", err)
+	}
+	export, err := id.Export(newPasswordFlag)
+	if err != nil {
+		fatalf(exitIdentity, "Failed to export identity: %v", err)
+	}
+	fmt.Println(export)
+}
+
+// identityPubkey returns the base64 encoded public key of a decrypted identity.
+// The go-threema library does not expose the keys, but it does hold the public
+// key, so it's read out via reflection instead of decrypting the backup again
+// (the key derivation being the expensive part of loading an identity).
+func identityPubkey(id *threema.Identity) (string, error) {
+	field := reflect.ValueOf(id).Elem().FieldByName("publicKey")
+	if !field.IsValid() || field.Kind() != reflect.Ptr || field.IsNil() || field.Elem().Kind() != reflect.Array {
+		return "", errors.New("unsupported identity layout")
+	}
+	pubkey := make([]byte, field.Elem().Len())
+	for i := range pubkey {
+		pubkey[i] = byte(field.Elem().Index(i).Uint())
+	}
+	return base64.StdEncoding.EncodeToString(pubkey), nil
+}
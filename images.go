@@ -0,0 +1,262 @@
+// Copyright 2021 Péter Szilágyi. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// imageSource is an image to download and attach to an alert.
+type imageSource struct {
+	url    string // URL to download the image from
+	render bool   // Whether the image is rendered by Grafana, requiring auth
+}
+
+// panelRenderURL converts a link to a Grafana dashboard panel into the URL to
+// render it through Grafana's image renderer, e.g.
+//
+//	http://grafana/d/uid/slug?orgId=1&viewPanel=2
+//	http://grafana/render/d-solo/uid/slug?height=500&orgId=1&panelId=2&width=1000
+//
+// Links without a panel reference cannot be rendered and are rejected.
+func panelRenderURL(link string, width int, height int) (string, error) {
+	u, err := url.Parse(link)
+	if err != nil {
+		return "", err
+	}
+	query := u.Query()
+
+	panel := query.Get("viewPanel")
+	if panel == "" {
+		panel = query.Get("panelId")
+	}
+	if panel == "" {
+		return "", fmt.Errorf("no panel referenced in %s", link)
+	}
+	idx := strings.Index(u.Path, "/d/")
+	if idx < 0 {
+		return "", fmt.Errorf("no dashboard referenced in %s", link)
+	}
+	u.Path = u.Path[:idx] + "/render/d-solo/" + u.Path[idx+len("/d/"):]
+
+	query.Del("viewPanel")
+	query.Set("panelId", panel)
+	query.Set("width", strconv.Itoa(width))
+	query.Set("height", strconv.Itoa(height))
+	u.RawQuery = query.Encode()
+
+	return u.String(), nil
+}
+
+// imageSlots is a semaphore limiting the number of concurrent image downloads,
+// nil if unlimited.
+var imageSlots chan struct{}
+
+// downloadImage retrieves an image attachment from the given URL, retrying a
+// number of times if the download fails. Grafana's image renderer may report a
+// transient server error while the render is still in progress, so a failure
+// isn't necessarily final.
+//
+// If concurrent downloads are limited, the download waits for a free slot, but
+// gives up after a timeout so the alert can still be sent without the image.
+// The whole download is also aborted if the context is cancelled.
+//
+// Images rendered by Grafana are requested with the configured render token.
+// Apart from the image, the content type declared by the server is returned.
+func downloadImage(ctx context.Context, source *imageSource, retries int, delay time.Duration) ([]byte, string, error) {
+	if imageSlots != nil {
+		select {
+		case imageSlots <- struct{}{}:
+			defer func() { <-imageSlots }()
+		case <-time.After(imageSlotTimeoutFlag):
+			return nil, "", errors.New("timed out waiting for a download slot")
+		case <-ctx.Done():
+			return nil, "", ctx.Err()
+		}
+	}
+	var err error
+	for attempt := 0; attempt <= retries; attempt++ {
+		if attempt > 0 {
+			log.Printf("Retrying image download (%d/%d) after: %v", attempt, retries, err)
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return nil, "", ctx.Err()
+			}
+		}
+		var (
+			image []byte
+			kind  string
+		)
+		if image, kind, err = fetchImage(ctx, source); err == nil {
+			return image, kind, nil
+		}
+		if ctx.Err() != nil {
+			return nil, "", ctx.Err()
+		}
+		var permanent *permanentImageError
+		if errors.As(err, &permanent) {
+			break
+		}
+	}
+	return nil, "", err
+}
+
+// imageClient is the HTTP client downloading the image attachments, following
+// redirects with the auth preserved.
+var imageClient = &http.Client{CheckRedirect: followImageRedirect}
+
+// followImageRedirect decides whether to follow a redirect of an image download.
+// Redirect chains beyond the configured limit are aborted, and the auth header of
+// the original request is reapplied on redirects to the same host, so a render
+// bouncing through a login or signing step isn't answered with 403 Forbidden.
+// Redirects to other hosts (e.g. signed URLs of an object store) don't get it,
+// not to leak the token.
+func followImageRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) > imageMaxRedirectsFlag {
+		log.Printf("Aborting image download from %s after %d redirects", via[0].URL, len(via)-1)
+		return fmt.Errorf("stopped after %d redirects", len(via)-1)
+	}
+	if auth := via[0].Header.Get("Authorization"); auth != "" && req.URL.Host == via[0].URL.Host {
+		req.Header.Set("Authorization", auth)
+	}
+	return nil
+}
+
+// permanentImageError is a failed image download that is pointless to retry,
+// because the server refused the request (e.g. 404 Not Found) or the image is
+// larger than allowed.
+type permanentImageError struct {
+	reason string
+}
+
+// Error implements the error interface.
+func (e *permanentImageError) Error() string {
+	return e.reason
+}
+
+// fetchImage does a single attempt at downloading an image attachment.
+func fetchImage(ctx context.Context, source *imageSource) ([]byte, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source.url, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	if source.render && imageRenderTokenFlag != "" {
+		req.Header.Set("Authorization", "Bearer "+imageRenderTokenFlag)
+	}
+	res, err := imageClient.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer res.Body.Close()
+
+	// Anything but a success is an error page, not an image. Server errors and
+	// throttling might be transient (e.g. a render in progress), the rest isn't.
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		log.Printf("Image download from %s failed with status %d", source.url, res.StatusCode)
+		if res.StatusCode >= http.StatusInternalServerError || res.StatusCode == http.StatusTooManyRequests {
+			return nil, "", fmt.Errorf("server error: %s", res.Status)
+		}
+		return nil, "", &permanentImageError{reason: "unexpected status: " + res.Status}
+	}
+	// Read one byte above the limit, to tell a maximum sized image apart from
+	// a larger one being cut off
+	image, err := ioutil.ReadAll(io.LimitReader(res.Body, imageMaxDownloadFlag+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if int64(len(image)) > imageMaxDownloadFlag {
+		log.Printf("Image download from %s exceeded %d bytes", source.url, imageMaxDownloadFlag)
+		return nil, "", &permanentImageError{reason: fmt.Sprintf("image larger than %d bytes", imageMaxDownloadFlag)}
+	}
+	return image, res.Header.Get("Content-Type"), nil
+}
+
+// convertImage re-encodes a downloaded image into the requested format to save
+// bandwidth, currently only `jpeg` (at the given quality) or `original` (left
+// as is). Images already in JPEG, and ones with transparency (which JPEG can't
+// represent), are kept as they are, as is the original on any failure.
+func convertImage(blob []byte, format string, quality int) []byte {
+	if format != "jpeg" {
+		return blob
+	}
+	img, kind, err := image.Decode(bytes.NewReader(blob))
+	if err != nil {
+		log.Printf("Failed to decode image for conversion: %v", err)
+		return blob
+	}
+	if kind == "jpeg" {
+		return blob
+	}
+	if opaque, ok := img.(interface{ Opaque() bool }); ok && !opaque.Opaque() {
+		return blob
+	}
+	buf := new(bytes.Buffer)
+	if err := jpeg.Encode(buf, img, &jpeg.Options{Quality: quality}); err != nil {
+		log.Printf("Failed to convert image to JPEG: %v", err)
+		return blob
+	}
+	debugf("Converted %s image of %d bytes to JPEG of %d bytes", kind, len(blob), buf.Len())
+	return buf.Bytes()
+}
+
+// uselessImage checks whether a downloaded image is worth attaching, returning
+// the reason for skipping it, or an empty string if it's fine. Tiny images are
+// usually error placeholders from the renderer, whilst huge ones are a waste of
+// bandwidth on a mobile device. A zero limit disables the respective check.
+func uselessImage(image []byte, min int, max int) string {
+	if min > 0 && len(image) < min {
+		return fmt.Sprintf("%d bytes below the useful minimum of %d", len(image), min)
+	}
+	if max > 0 && len(image) > max {
+		return fmt.Sprintf("%d bytes above the limit of %d", len(image), max)
+	}
+	return ""
+}
+
+// unexpectedImage checks whether a downloaded image is of an allowed type, both
+// by the content type declared by the server (if any) and by sniffing the data,
+// returning the reason for skipping it, or an empty string if it's fine. This
+// catches HTML error pages and other junk being served in place of a render.
+func unexpectedImage(image []byte, declared string, allowed []string) string {
+	if declared != "" {
+		kind, _, err := mime.ParseMediaType(declared)
+		if err != nil {
+			return fmt.Sprintf("invalid content type %q", declared)
+		}
+		if !allowedType(kind, allowed) {
+			return fmt.Sprintf("declared content type %s not allowed", kind)
+		}
+	}
+	kind, _, _ := mime.ParseMediaType(http.DetectContentType(image))
+	if !allowedType(kind, allowed) {
+		return fmt.Sprintf("detected content type %s not allowed", kind)
+	}
+	return ""
+}
+
+// allowedType checks whether a media type is contained in an allowlist.
+func allowedType(kind string, allowed []string) bool {
+	for _, allow := range allowed {
+		if strings.EqualFold(strings.TrimSpace(allow), kind) {
+			return true
+		}
+	}
+	return false
+}
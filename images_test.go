@@ -0,0 +1,56 @@
+// Copyright 2021 Péter Szilágyi. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Tests that image downloads above the size limit are aborted as a permanent
+// failure, while ones at the limit go through.
+func TestFetchImageSizeLimit(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte(strings.Repeat("x", 16)))
+	}))
+	defer server.Close()
+
+	defer func(limit int64) { imageMaxDownloadFlag = limit }(imageMaxDownloadFlag)
+
+	imageMaxDownloadFlag = 16
+	if image, _, err := fetchImage(context.Background(), &imageSource{url: server.URL}); err != nil || len(image) != 16 {
+		t.Fatalf("image at limit: got %d bytes, err %v", len(image), err)
+	}
+	imageMaxDownloadFlag = 15
+	_, _, err := fetchImage(context.Background(), &imageSource{url: server.URL})
+
+	var permanent *permanentImageError
+	if !errors.As(err, &permanent) {
+		t.Fatalf("image above limit: got err %v, want permanent error", err)
+	}
+}
+
+// Tests that a stalled image download is aborted by the client timeout.
+func TestFetchImageTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	defer func(timeout time.Duration) { imageClient.Timeout = timeout }(imageClient.Timeout)
+	imageClient.Timeout = 50 * time.Millisecond
+
+	if _, _, err := fetchImage(context.Background(), &imageSource{url: server.URL}); err == nil {
+		t.Fatalf("stalled download succeeded")
+	}
+}
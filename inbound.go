@@ -0,0 +1,95 @@
+// Copyright 2021 Péter Szilágyi. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/karalabe/go-threema"
+)
+
+// inboundAction is an action triggered by a text message sent to the forwarder's
+// identity by one of its contacts, e.g. a recipient replying to an alert.
+type inboundAction func(msg *inboundMessage) error
+
+// inboundMessage is a text message received from a Threema contact, also used as
+// the JSON payload posted to the inbound webhook.
+type inboundMessage struct {
+	From string `json:"from"`
+	Nick string `json:"nick,omitempty"`
+	Time string `json:"time"`
+	Text string `json:"text"`
+}
+
+// inboundActions are the actions to run on each received message, none if the
+// inbound messages are ignored.
+var inboundActions []inboundAction
+
+// newInboundActions creates the actions to run on inbound messages requested
+// via the command line flags.
+func newInboundActions(logged bool, webhook string) []inboundAction {
+	var actions []inboundAction
+	if logged {
+		actions = append(actions, func(msg *inboundMessage) error {
+			log.Printf("Received message from %s (%s): %q", msg.From, msg.Nick, msg.Text)
+			return nil
+		})
+	}
+	if webhook != "" {
+		client := &http.Client{Timeout: sinkTimeout}
+		actions = append(actions, func(msg *inboundMessage) error {
+			blob, err := json.Marshal(msg)
+			if err != nil {
+				return err
+			}
+			res, err := client.Post(webhook, "application/json", bytes.NewReader(blob))
+			if err != nil {
+				return err
+			}
+			defer res.Body.Close()
+
+			if res.StatusCode < 200 || res.StatusCode >= 300 {
+				return fmt.Errorf("inbound webhook rejected message: %s", res.Status)
+			}
+			return nil
+		})
+	}
+	return actions
+}
+
+// newInboundHandler creates a Threema event handler that dispatches the received
+// text messages to the configured actions, calling closed when the connection
+// terminates. Actions are run on a background goroutine so a slow one never
+// blocks the connection.
+func newInboundHandler(closed func()) *threema.Handler {
+	handler := &threema.Handler{Closed: closed}
+	if len(inboundActions) == 0 {
+		return handler
+	}
+	handler.Message = func(from string, nick string, when time.Time, text string) {
+		msg := &inboundMessage{
+			From: from,
+			Nick: nick,
+			Time: when.UTC().Format(time.RFC3339),
+			Text: text,
+		}
+		go func() {
+			for _, action := range inboundActions {
+				if err := action(msg); err != nil {
+					log.Printf("Failed to handle message from %s: %v", from, err)
+				}
+			}
+		}()
+	}
+	handler.Spam = func(from string, nick string, when time.Time) {
+		log.Printf("Ignoring message from unknown Threema user %s (%s)", from, nick)
+	}
+	return handler
+}
@@ -0,0 +1,55 @@
+// Copyright 2021 Péter Szilágyi. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+)
+
+// maxIncidents is the number of open incidents to track before forgetting the
+// old ones. It's a safety net against incidents that never resolve.
+const maxIncidents = 1024
+
+// incidentTracker assigns short tags to the incidents alerts belong to, so that
+// related alerts can be visually grouped in the chat. Threema has no notion of
+// replies that could be used across the protocol, so grouping is done by tags.
+type incidentTracker struct {
+	seen map[string]bool // Incident keys already announced
+	lock sync.Mutex
+}
+
+// newIncidentTracker creates an empty incident tracker.
+func newIncidentTracker() *incidentTracker {
+	return &incidentTracker{
+		seen: make(map[string]bool),
+	}
+}
+
+// tag returns the display tag for an incident, marking follow-ups to an already
+// announced incident. A resolved incident is forgotten, so a recurrence starts
+// a fresh one.
+func (t *incidentTracker) tag(key string, resolved bool) string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	hash := sha256.Sum256([]byte(key))
+	tag := "[#" + hex.EncodeToString(hash[:2]) + "]"
+
+	followup := t.seen[key]
+	if resolved {
+		delete(t.seen, key)
+	} else {
+		if len(t.seen) >= maxIncidents {
+			t.seen = make(map[string]bool)
+		}
+		t.seen[key] = true
+	}
+	if followup {
+		return "↪ " + tag
+	}
+	return tag
+}
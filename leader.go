@@ -0,0 +1,44 @@
+// Copyright 2021 Péter Szilágyi. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package main
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// leaderPollInterval is the time to wait between attempts at acquiring the
+// leader lock while following.
+const leaderPollInterval = time.Second
+
+// leaderLock is the file holding the leader lock, kept referenced so it's not
+// closed (and the lock released) by the garbage collector.
+var leaderLock *os.File
+
+// awaitLeadership blocks until an exclusive lock is acquired on the given file,
+// making this forwarder the leader among the replicas sharing it. The lock is
+// held until the process exits, at which point the operating system releases
+// it, even if the process crashed, letting a follower take over.
+func awaitLeadership(path string) error {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	for {
+		err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			leaderLock = file
+			return nil
+		}
+		if err != syscall.EWOULDBLOCK {
+			file.Close()
+			return err
+		}
+		time.Sleep(leaderPollInterval)
+	}
+}
@@ -0,0 +1,18 @@
+// Copyright 2021 Péter Szilágyi. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// awaitLeadership would block until an exclusive lock is acquired on the given
+// file, but the lock relies on flock, which this platform doesn't have.
+func awaitLeadership(path string) error {
+	return fmt.Errorf("leader election is not supported on %s", runtime.GOOS)
+}
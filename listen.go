@@ -0,0 +1,56 @@
+// Copyright 2021 Péter Szilágyi. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// listen opens a network listener for every address in a comma separated list.
+// Addresses are TCP host:port pairs, or Unix domain sockets in the form of
+// `unix:/path/to/sock`.
+func listen(addrs string) ([]net.Listener, error) {
+	var listeners []net.Listener
+	for _, addr := range strings.Split(addrs, ",") {
+		network := "tcp"
+		if strings.HasPrefix(addr, "unix:") {
+			network, addr = "unix", strings.TrimPrefix(addr, "unix:")
+
+			// Remove any stale socket left over by a crashed run, but refuse to
+			// touch anything else at the path. The listener itself cleans the
+			// socket file up when closed on shutdown.
+			if info, err := os.Lstat(addr); err == nil {
+				if info.Mode()&os.ModeSocket == 0 {
+					closeListeners(listeners)
+					return nil, fmt.Errorf("%s exists and is not a socket", addr)
+				}
+				if err := os.Remove(addr); err != nil {
+					closeListeners(listeners)
+					return nil, err
+				}
+			} else if !os.IsNotExist(err) {
+				closeListeners(listeners)
+				return nil, err
+			}
+		}
+		listener, err := net.Listen(network, addr)
+		if err != nil {
+			closeListeners(listeners)
+			return nil, err
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
+
+// closeListeners tears down a batch of network listeners.
+func closeListeners(listeners []net.Listener) {
+	for _, listener := range listeners {
+		listener.Close()
+	}
+}
@@ -0,0 +1,44 @@
+// Copyright 2021 Péter Szilágyi. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Tests that a stale Unix socket is replaced, but a regular file at the socket
+// path is left alone and reported.
+func TestListenUnixStale(t *testing.T) {
+	dir := t.TempDir()
+
+	sock := filepath.Join(dir, "g2t.sock")
+	stale, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatalf("failed to create stale socket: %v", err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	listeners, err := listen("unix:" + sock)
+	if err != nil {
+		t.Fatalf("failed to replace stale socket: %v", err)
+	}
+	closeListeners(listeners)
+
+	file := filepath.Join(dir, "config.yaml")
+	if err := ioutil.WriteFile(file, []byte("routes: []"), 0600); err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+	if _, err := listen("unix:" + file); err == nil {
+		t.Fatalf("listened over a regular file")
+	}
+	if _, err := os.Stat(file); err != nil {
+		t.Fatalf("regular file removed: %v", err)
+	}
+}
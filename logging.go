@@ -0,0 +1,53 @@
+// Copyright 2021 Péter Szilágyi. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// setupLogging redirects the log output into a size rotated file if one was
+// requested, optionally teeing it to stdout too. The file is reopened on SIGHUP
+// to play nice with external log rotation tools.
+func setupLogging() {
+	if logFileFlag == "" {
+		return
+	}
+	file := &lumberjack.Logger{
+		Filename:   logFileFlag,
+		MaxSize:    logMaxSizeFlag,
+		MaxAge:     logMaxAgeFlag,
+		MaxBackups: logMaxBackupsFlag,
+	}
+	var out io.Writer = file
+	if logStdoutFlag {
+		out = io.MultiWriter(os.Stdout, file)
+	}
+	log.SetOutput(out)
+
+	go func() {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		for range hup {
+			// Closing the file makes the next write reopen it by name
+			if err := file.Close(); err != nil {
+				log.Printf("Failed to reopen log file: %v", err)
+			}
+		}
+	}()
+}
+
+// debugf logs a message only if debug logging was requested.
+func debugf(format string, args ...interface{}) {
+	if logDebugFlag {
+		log.Printf("DEBUG: "+format, args...)
+	}
+}
@@ -5,187 +5,916 @@
 package main
 
 import (
-	"encoding/json"
-	"fmt"
-	"io/ioutil"
+	"context"
+	"errors"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
-	"github.com/karalabe/go-threema"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
 
 var (
-	identityFlag        string
-	passwordFlag        string
-	recipientIDFlag     string
-	recipientPubKeyFlag string
+	identityFlag          string
+	passwordFlag          string
+	newPasswordFlag       string
+	doctorConnectFlag     bool
+	recipientIDFlag       string
+	recipientPubKeyFlag   string
+	recipientVerifyFlag   bool
+	recipientFetchFlag    bool
+	directoryCAFlag       string
+	recipientEmptyFlag    string
+	payloadRecipientsFlag bool
+	trustLazyFlag         bool
+
+	listenFlag            string
+	connWarmupFlag        bool
+	connHealthFlag        time.Duration
+	connPingFlag          time.Duration
+	standbyFlag           bool
+	leaderLockFlag        string
+	droppedStatusFlag     int
+	maxBodyFlag           int64
+	handlerTimeoutFlag    time.Duration
+	webhookRetryAfterFlag time.Duration
+	webhookInflightFlag   int
+	webhookStrictFlag     bool
+	webhookPathFlag       string
+	webhookTokenFlag      string
+	webhookHMACFlag       string
+
+	webhookTestMarkerFlag string
+	webhookTestModeFlag   string
+
+	adminUIFlag     bool
+	adminUserFlag   string
+	adminSecretFlag string
+
+	imageAttachFlag     bool
+	imageRetriesFlag    int
+	imageRetryDelayFlag time.Duration
+	imageMaxCountFlag   int
+	imageMinBytesFlag   int
+	imageMaxBytesFlag   int
+	imageTypesFlag      string
+	imageFormatFlag     string
+	imageQualityFlag    int
+	imageGridFlag       bool
+	imageCaptionFlag    string
+
+	imageRenderTokenFlag  string
+	imageMaxRedirectsFlag int
+	imageTimeoutFlag      time.Duration
+	imageMaxDownloadFlag  int64
+	imageRenderWidthFlag  int
+	imageRenderHeightFlag int
+
+	imageMaxConcurrentFlag int
+	imageSlotTimeoutFlag   time.Duration
+
+	queueFileFlag       string
+	queueMaxAgeFlag     time.Duration
+	queueKeepCritFlag   bool
+	retryFileFlag       string
+	retryMaxFlag        int
+	retryBackoffFlag    time.Duration
+	retryMaxBackoffFlag time.Duration
+
+	shutdownGraceFlag time.Duration
+	shutdownModeFlag  string
+	drainTimeoutFlag  time.Duration
+
+	timezoneFlag   string
+	timeFormatFlag string
+
+	notifyWebhookFlag string
+	notifyTimeoutFlag time.Duration
+
+	sinkStdoutFlag         bool
+	sinkFileFlag           string
+	sinkFileMaxSizeFlag    int
+	sinkFileMaxBackupsFlag int
+	sinkWebhookFlag        string
+
+	inboundLogFlag       bool
+	inboundWebhookFlag   string
+	inboundSnoozeFlag    bool
+	inboundAckFlag       bool
+	inboundSnoozeMaxFlag time.Duration
+
+	dedupWindowFlag    time.Duration
+	dedupRecipientFlag time.Duration
+	dedupRcptSizeFlag  int
+
+	enrichURLFlag     string
+	enrichTimeoutFlag time.Duration
+	enrichTTLFlag     time.Duration
+	dedupSizeFlag     int
+	debounceFlag      time.Duration
+
+	idempotencyWindowFlag time.Duration
+
+	rateLimitFlag      int
+	batchWindowFlag    time.Duration
+	sendOrderFlag      string
+	digestIntervalFlag time.Duration
+
+	coalesceFlag    bool
+	coalesceKeyFlag string
+
+	incidentTagsFlag  bool
+	incidentLabelFlag string
+
+	heartbeatIntervalFlag time.Duration
+	heartbeatToFlag       string
+
+	lifecycleToFlag    string
+	lifecycleStartFlag string
+	lifecycleStopFlag  string
+
+	formatTemplateFlag string
+	formatTestFlag     string
+	formatPlainFlag    bool
+	formatCompactFlag  bool
+	formatMaxBodyFlag  int
+	formatMaxBytesFlag int
+
+	formatStripPrefixFlag bool
+	formatLinksFlag       string
+	formatMatchesFlag     string
+	formatNumberFlag      string
+
+	formatCollapseResolvedFlag bool
+
+	debugPayloadFlag bool
+	debugToFlag      string
+	debugRedactFlag  string
+
+	webhookLogBodyFlag    bool
+	webhookLogBodyMaxFlag int
+
+	logFileFlag       string
+	auditFileFlag     string
+	logStdoutFlag     bool
+	logDebugFlag      bool
+	logMaxSizeFlag    int
+	logMaxAgeFlag     int
+	logMaxBackupsFlag int
+
+	configFileFlag   string
+	configFormatFlag string
+	configPrintFlag  bool
 )
 
 func main() {
 	viper.AutomaticEnv()
+	viper.SetDefault("G2T_LISTEN", "0.0.0.0:8000")
+	viper.SetDefault("G2T_WEBHOOK_DROPPED_STATUS", http.StatusOK)
+	viper.SetDefault("G2T_WEBHOOK_MAX_BODY", 10<<20)
+	viper.SetDefault("G2T_WEBHOOK_TEST_MARKER", "Test notification")
+	viper.SetDefault("G2T_WEBHOOK_TEST_MODE", "forward")
+	viper.SetDefault("G2T_IMAGE_ATTACH", true)
+	viper.SetDefault("G2T_IMAGE_RETRIES", 3)
+	viper.SetDefault("G2T_IMAGE_MAX_REDIRECTS", 10)
+	viper.SetDefault("G2T_IMAGE_TIMEOUT", 30*time.Second)
+	viper.SetDefault("G2T_IMAGE_MAX_DOWNLOAD", 16*1024*1024)
+	viper.SetDefault("G2T_IMAGE_RETRY_DELAY", time.Second)
+	viper.SetDefault("G2T_IMAGE_MAX_COUNT", 4)
+	viper.SetDefault("G2T_IMAGE_SLOT_TIMEOUT", 10*time.Second)
+	viper.SetDefault("G2T_IMAGE_ALLOWED_TYPES", "image/png,image/jpeg,image/gif")
+	viper.SetDefault("G2T_IMAGE_FORMAT", "original")
+	viper.SetDefault("G2T_IMAGE_QUALITY", 80)
+	viper.SetDefault("G2T_IMAGE_RENDER_WIDTH", 1000)
+	viper.SetDefault("G2T_IMAGE_RENDER_HEIGHT", 500)
+	viper.SetDefault("G2T_INBOUND_SNOOZE_MAX", 24*time.Hour)
+	viper.SetDefault("G2T_WEBHOOK_PATH", "/")
+	viper.SetDefault("G2T_FORMAT_LINKS", "keep")
+	viper.SetDefault("G2T_FORMAT_MATCHES", "full")
+	viper.SetDefault("G2T_FORMAT_NUMBER", "fixed")
+	viper.SetDefault("G2T_SEND_ORDER", "listed")
+	viper.SetDefault("G2T_WEBHOOK_LOG_BODY_MAX", 4096)
+	viper.SetDefault("G2T_WEBHOOK_RETRY_AFTER", 30*time.Second)
+	viper.SetDefault("G2T_WEBHOOK_MAX_INFLIGHT", 0)
+	viper.SetDefault("G2T_RETRY_MAX", 5)
+	viper.SetDefault("G2T_RETRY_BACKOFF", 30*time.Second)
+	viper.SetDefault("G2T_RETRY_MAX_BACKOFF", time.Hour)
+	viper.SetDefault("G2T_SHUTDOWN_GRACE", 10*time.Second)
+	viper.SetDefault("G2T_TIMEZONE", "UTC")
+	viper.SetDefault("G2T_NOTIFY_TIMEOUT", 5*time.Second)
+	viper.SetDefault("G2T_DEDUP_SIZE", 1024)
+	viper.SetDefault("G2T_DEDUP_RECIPIENT_SIZE", 4096)
+	viper.SetDefault("G2T_ENRICH_TIMEOUT", 2*time.Second)
+	viper.SetDefault("G2T_ENRICH_CACHE_TTL", 5*time.Minute)
+	viper.SetDefault("G2T_LOG_MAX_SIZE", 100)
+	viper.SetDefault("G2T_TIME_FORMAT", "datetime")
+	viper.SetDefault("G2T_FORMAT_STRIP_PREFIX", true)
+	viper.SetDefault("G2T_LIFECYCLE_START_MESSAGE", "Forwarder started")
+	viper.SetDefault("G2T_LIFECYCLE_STOP_MESSAGE", "Forwarder shutting down")
 
 	rootCmd := &cobra.Command{
 		Use:   "grafana-threema-forwarder",
 		Short: "Grafana to Threema alert forwarder",
-		Run:   forwarder,
+		PersistentPreRun: func(cmd *cobra.Command, args []string) {
+			if err := resolveSecrets(cmd.Flags()); err != nil {
+				fatalf(exitConfig, "Failed to resolve secret: %v", err)
+			}
+		},
+		Run: forwarder,
 	}
-	rootCmd.Flags().StringVar(&identityFlag, "id", viper.GetString("G2T_ID_BACKUP"), "Exported and password protected Threema identity (G2T_ID_BACKUP)")
-	rootCmd.Flags().StringVar(&passwordFlag, "id.secret", viper.GetString("G2T_ID_SECRET"), "Decryption password used to export the identity (G2T_ID_SECRET)")
-	rootCmd.Flags().StringVar(&recipientIDFlag, "to", viper.GetString("G2T_RCPT_ID"), "Threema ID(s) to forward the Grafana alerts to (G2T_RCPT_ID)")
-	rootCmd.Flags().StringVar(&recipientPubKeyFlag, "to.pubkey", viper.GetString("G2T_RCPT_PUBKEY"), "Threema public key(s) of the recipient(s) (G2T_RCPT_PUBKEY)")
+	rootCmd.PersistentFlags().StringVar(&identityFlag, "id", viper.GetString("G2T_ID_BACKUP"), "Exported and password protected Threema identity (G2T_ID_BACKUP)")
+	rootCmd.PersistentFlags().StringVar(&passwordFlag, "id.secret", viper.GetString("G2T_ID_SECRET"), "Decryption password used to export the identity (G2T_ID_SECRET)")
+	rootCmd.PersistentFlags().StringVar(&recipientIDFlag, "to", viper.GetString("G2T_RCPT_ID"), "Threema ID(s) to forward the Grafana alerts to (G2T_RCPT_ID)")
+	rootCmd.PersistentFlags().StringVar(&recipientPubKeyFlag, "to.pubkey", viper.GetString("G2T_RCPT_PUBKEY"), "Threema public key(s) of the recipient(s) (G2T_RCPT_PUBKEY)")
+	rootCmd.Flags().BoolVar(&recipientVerifyFlag, "to.verify", viper.GetBool("G2T_RCPT_VERIFY"), "Verify the recipient pubkeys against the Threema directory on startup (G2T_RCPT_VERIFY)")
+	rootCmd.PersistentFlags().BoolVar(&recipientFetchFlag, "to.fetch-pubkeys", viper.GetBool("G2T_RCPT_FETCH_PUBKEYS"), "Fetch missing recipient pubkeys from the Threema directory (G2T_RCPT_FETCH_PUBKEYS)")
+	rootCmd.PersistentFlags().StringVar(&directoryCAFlag, "directory.ca", viper.GetString("G2T_DIRECTORY_CA"), "PEM file with the CA certificate(s) to verify the Threema directory with instead of the system roots (G2T_DIRECTORY_CA)")
+	rootCmd.Flags().StringVar(&recipientEmptyFlag, "to.empty-fallback", viper.GetString("G2T_RCPT_EMPTY_FALLBACK"), "Recipient(s) to send alerts left without any recipients to, instead of dropping them (G2T_RCPT_EMPTY_FALLBACK)")
+	rootCmd.Flags().BoolVar(&trustLazyFlag, "trust.lazy", viper.GetBool("G2T_TRUST_LAZY"), "Add the recipients as contacts on their first delivery instead of on startup (G2T_TRUST_LAZY)")
+	rootCmd.Flags().BoolVar(&payloadRecipientsFlag, "allow-payload-recipients", viper.GetBool("G2T_ALLOW_PAYLOAD_RECIPIENTS"), "Let alerts pick their recipients via a threema_to label, overriding the routing (G2T_ALLOW_PAYLOAD_RECIPIENTS)")
+	rootCmd.Flags().StringVar(&listenFlag, "listen", viper.GetString("G2T_LISTEN"), "Comma separated TCP addresses or unix:/path sockets to listen on (G2T_LISTEN)")
+	rootCmd.Flags().BoolVar(&standbyFlag, "standby", viper.GetBool("G2T_STANDBY"), "Accept webhooks but hold the alerts until promoted via SIGUSR1 or the admin UI (G2T_STANDBY)")
+	rootCmd.Flags().StringVar(&leaderLockFlag, "leader.lock", viper.GetString("G2T_LEADER_LOCK"), "Shared lock file electing the single replica delivering alerts, others stay standby (G2T_LEADER_LOCK)")
+	rootCmd.Flags().BoolVar(&connWarmupFlag, "conn.warmup", viper.GetBool("G2T_CONN_WARMUP"), "Connect to Threema on startup and keep the connection open between alerts (G2T_CONN_WARMUP)")
+	rootCmd.Flags().DurationVar(&connHealthFlag, "conn.health-interval", viper.GetDuration("G2T_CONN_HEALTH_INTERVAL"), "Interval to check the connectivity to Threema at while not connected, 0 = disabled (G2T_CONN_HEALTH_INTERVAL)")
+	rootCmd.Flags().DurationVar(&connPingFlag, "conn.ping-interval", viper.GetDuration("G2T_CONN_PING_INTERVAL"), "Maximum time to keep a warm connection idle before recycling it, 0 = disabled (G2T_CONN_PING_INTERVAL)")
+	rootCmd.Flags().Int64Var(&maxBodyFlag, "webhook.max-body", viper.GetInt64("G2T_WEBHOOK_MAX_BODY"), "Maximum size of a webhook body in bytes, after decompression (G2T_WEBHOOK_MAX_BODY)")
+	rootCmd.Flags().DurationVar(&webhookRetryAfterFlag, "webhook.retry-after", viper.GetDuration("G2T_WEBHOOK_RETRY_AFTER"), "Base delay to hint senders to retry rejected webhooks after, scaled by the queue backlog (G2T_WEBHOOK_RETRY_AFTER)")
+	rootCmd.Flags().IntVar(&webhookInflightFlag, "webhook.max-inflight", viper.GetInt("G2T_WEBHOOK_MAX_INFLIGHT"), "Maximum number of webhooks to handle concurrently, 0 = unlimited (G2T_WEBHOOK_MAX_INFLIGHT)")
+	rootCmd.Flags().DurationVar(&handlerTimeoutFlag, "handler.timeout", viper.GetDuration("G2T_HANDLER_TIMEOUT"), "Maximum time to spend handling a webhook, including image downloads (0 = unlimited) (G2T_HANDLER_TIMEOUT)")
+	rootCmd.Flags().StringVar(&webhookPathFlag, "webhook.path", viper.GetString("G2T_WEBHOOK_PATH"), "HTTP path to accept the Grafana webhooks on (G2T_WEBHOOK_PATH)")
+	rootCmd.Flags().StringVar(&webhookTokenFlag, "webhook.token", viper.GetString("G2T_WEBHOOK_TOKEN"), "Token required to post webhooks, as a bearer token or basic auth password (G2T_WEBHOOK_TOKEN)")
+	rootCmd.Flags().StringVar(&webhookHMACFlag, "webhook.hmac-secret", viper.GetString("G2T_WEBHOOK_HMAC_SECRET"), "Secret to verify Grafana's HMAC-SHA256 webhook signatures with (G2T_WEBHOOK_HMAC_SECRET)")
+	rootCmd.Flags().BoolVar(&webhookStrictFlag, "webhook.strict", viper.GetBool("G2T_WEBHOOK_STRICT"), "Reject Grafana payloads with unknown fields to detect schema drift (G2T_WEBHOOK_STRICT)")
+	rootCmd.Flags().StringVar(&webhookTestMarkerFlag, "webhook.test-marker", viper.GetString("G2T_WEBHOOK_TEST_MARKER"), "Text in the title or rule name identifying test notifications (G2T_WEBHOOK_TEST_MARKER)")
+	rootCmd.Flags().StringVar(&webhookTestModeFlag, "webhook.test-mode", viper.GetString("G2T_WEBHOOK_TEST_MODE"), "Handling of test notifications: forward to Threema, or echo back what would be sent (G2T_WEBHOOK_TEST_MODE)")
+	rootCmd.Flags().IntVar(&droppedStatusFlag, "webhook.dropped-status", viper.GetInt("G2T_WEBHOOK_DROPPED_STATUS"), "HTTP status to respond with for deliberately dropped alerts (G2T_WEBHOOK_DROPPED_STATUS)")
+	rootCmd.Flags().BoolVar(&adminUIFlag, "admin.ui", viper.GetBool("G2T_ADMIN_UI"), "Enable the web UI for sending manual messages at /admin/send (G2T_ADMIN_UI)")
+	rootCmd.Flags().StringVar(&adminUserFlag, "admin.user", viper.GetString("G2T_ADMIN_USER"), "Username for accessing the admin web UI (G2T_ADMIN_USER)")
+	rootCmd.Flags().StringVar(&adminSecretFlag, "admin.secret", viper.GetString("G2T_ADMIN_SECRET"), "Password for accessing the admin web UI (G2T_ADMIN_SECRET)")
+	rootCmd.Flags().BoolVar(&imageAttachFlag, "image.attach", viper.GetBool("G2T_IMAGE_ATTACH"), "Download and attach alert images, overridable via the threema_image label (G2T_IMAGE_ATTACH)")
+	rootCmd.Flags().IntVar(&imageRetriesFlag, "image.retries", viper.GetInt("G2T_IMAGE_RETRIES"), "Number of times to retry a failed image download (G2T_IMAGE_RETRIES)")
+	rootCmd.Flags().DurationVar(&imageRetryDelayFlag, "image.retry-delay", viper.GetDuration("G2T_IMAGE_RETRY_DELAY"), "Delay to wait between image download retries (G2T_IMAGE_RETRY_DELAY)")
+	rootCmd.Flags().IntVar(&imageMaxRedirectsFlag, "image.max-redirects", viper.GetInt("G2T_IMAGE_MAX_REDIRECTS"), "Maximum number of redirects to follow when downloading an image (G2T_IMAGE_MAX_REDIRECTS)")
+	rootCmd.Flags().DurationVar(&imageTimeoutFlag, "image.timeout", viper.GetDuration("G2T_IMAGE_TIMEOUT"), "Maximum time to spend on a single image download attempt (G2T_IMAGE_TIMEOUT)")
+	rootCmd.Flags().Int64Var(&imageMaxDownloadFlag, "image.max-download", viper.GetInt64("G2T_IMAGE_MAX_DOWNLOAD"), "Maximum size of a downloaded image in bytes, larger ones are aborted (G2T_IMAGE_MAX_DOWNLOAD)")
+	rootCmd.Flags().IntVar(&imageMaxCountFlag, "image.max-count", viper.GetInt("G2T_IMAGE_MAX_COUNT"), "Maximum number of images to attach to a single alert (G2T_IMAGE_MAX_COUNT)")
+	rootCmd.Flags().IntVar(&imageMaxConcurrentFlag, "image.max-concurrent", viper.GetInt("G2T_IMAGE_MAX_CONCURRENT"), "Maximum number of images to download concurrently (0 = unlimited) (G2T_IMAGE_MAX_CONCURRENT)")
+	rootCmd.Flags().DurationVar(&imageSlotTimeoutFlag, "image.slot-timeout", viper.GetDuration("G2T_IMAGE_SLOT_TIMEOUT"), "Maximum time to wait for a download slot before sending without the image (G2T_IMAGE_SLOT_TIMEOUT)")
+	rootCmd.Flags().IntVar(&imageMinBytesFlag, "image.min-useful-bytes", viper.GetInt("G2T_IMAGE_MIN_USEFUL_BYTES"), "Skip downloaded images smaller than this, likely render errors (0 = disabled) (G2T_IMAGE_MIN_USEFUL_BYTES)")
+	rootCmd.Flags().IntVar(&imageMaxBytesFlag, "image.skip-if-larger", viper.GetInt("G2T_IMAGE_SKIP_IF_LARGER"), "Skip downloaded images larger than this many bytes (0 = disabled) (G2T_IMAGE_SKIP_IF_LARGER)")
+	rootCmd.Flags().StringVar(&imageRenderTokenFlag, "image.render-token", viper.GetString("G2T_IMAGE_RENDER_TOKEN"), "Grafana service account token to render linked panels with (G2T_IMAGE_RENDER_TOKEN)")
+	rootCmd.Flags().IntVar(&imageRenderWidthFlag, "image.render-width", viper.GetInt("G2T_IMAGE_RENDER_WIDTH"), "Width in pixels to render linked panels with (G2T_IMAGE_RENDER_WIDTH)")
+	rootCmd.Flags().IntVar(&imageRenderHeightFlag, "image.render-height", viper.GetInt("G2T_IMAGE_RENDER_HEIGHT"), "Height in pixels to render linked panels with (G2T_IMAGE_RENDER_HEIGHT)")
+	rootCmd.Flags().StringVar(&imageCaptionFlag, "image.default-caption", viper.GetString("G2T_IMAGE_DEFAULT_CAPTION"), "Title to caption images with if the alert has no title or message (G2T_IMAGE_DEFAULT_CAPTION)")
+	rootCmd.Flags().BoolVar(&imageGridFlag, "image.grid", viper.GetBool("G2T_IMAGE_GRID"), "Compose the images of batched alerts into a single grid (G2T_IMAGE_GRID)")
+	rootCmd.Flags().StringVar(&imageFormatFlag, "image.format", viper.GetString("G2T_IMAGE_FORMAT"), "Format to re-encode the attached images into: original or jpeg (G2T_IMAGE_FORMAT)")
+	rootCmd.Flags().IntVar(&imageQualityFlag, "image.quality", viper.GetInt("G2T_IMAGE_QUALITY"), "Quality of the re-encoded JPEG images, 1-100 (G2T_IMAGE_QUALITY)")
+	rootCmd.Flags().StringVar(&imageTypesFlag, "image.allowed-types", viper.GetString("G2T_IMAGE_ALLOWED_TYPES"), "Comma separated content types of images to attach (G2T_IMAGE_ALLOWED_TYPES)")
+	rootCmd.Flags().StringVar(&queueFileFlag, "queue.file", viper.GetString("G2T_QUEUE_FILE"), "File to persist undelivered alerts into across restarts (G2T_QUEUE_FILE)")
+	rootCmd.Flags().DurationVar(&queueMaxAgeFlag, "queue.max-age", viper.GetDuration("G2T_QUEUE_MAX_AGE"), "Maximum time an alert may wait for delivery before being dropped, 0 = unlimited (G2T_QUEUE_MAX_AGE)")
+	rootCmd.Flags().BoolVar(&queueKeepCritFlag, "queue.keep-critical", viper.GetBool("G2T_QUEUE_KEEP_CRITICAL"), "Exempt alerts with critical severity from the maximum queue age (G2T_QUEUE_KEEP_CRITICAL)")
+	rootCmd.Flags().StringVar(&retryFileFlag, "retry.file", viper.GetString("G2T_RETRY_FILE"), "File to persist failed deliveries and their retry schedule into (G2T_RETRY_FILE)")
+	rootCmd.Flags().IntVar(&retryMaxFlag, "retry.max", viper.GetInt("G2T_RETRY_MAX"), "Maximum number of times to retry a failed delivery (G2T_RETRY_MAX)")
+	rootCmd.Flags().DurationVar(&retryBackoffFlag, "retry.backoff", viper.GetDuration("G2T_RETRY_BACKOFF"), "Initial delay before retrying a failed delivery, doubled on every failure (G2T_RETRY_BACKOFF)")
+	rootCmd.Flags().DurationVar(&retryMaxBackoffFlag, "retry.max-backoff", viper.GetDuration("G2T_RETRY_MAX_BACKOFF"), "Maximum delay between retries of a failed delivery (G2T_RETRY_MAX_BACKOFF)")
+	rootCmd.Flags().DurationVar(&shutdownGraceFlag, "shutdown.grace", viper.GetDuration("G2T_SHUTDOWN_GRACE"), "Maximum time to wait for a graceful shutdown (G2T_SHUTDOWN_GRACE)")
+	rootCmd.Flags().DurationVar(&drainTimeoutFlag, "drain-timeout", viper.GetDuration("G2T_DRAIN_TIMEOUT"), "Time to keep retrying each alert when flushing on shutdown, 0 = single attempt (G2T_DRAIN_TIMEOUT)")
+	rootCmd.Flags().StringVar(&shutdownModeFlag, "shutdown.mode", viper.GetString("G2T_SHUTDOWN_MODE"), "Handling of queued alerts on shutdown: flush or persist (G2T_SHUTDOWN_MODE)")
+	rootCmd.Flags().StringVar(&timezoneFlag, "timezone", viper.GetString("G2T_TIMEZONE"), "IANA timezone to render times in (G2T_TIMEZONE)")
+	rootCmd.Flags().StringVar(&timeFormatFlag, "time-format", viper.GetString("G2T_TIME_FORMAT"), "Go reference layout or preset (rfc3339, rfc1123, rfc822, kitchen, stamp, datetime) to render times with (G2T_TIME_FORMAT)")
+	rootCmd.Flags().StringVar(&notifyWebhookFlag, "notify.webhook", viper.GetString("G2T_NOTIFY_WEBHOOK"), "URL to POST delivery reports to after each send attempt (G2T_NOTIFY_WEBHOOK)")
+	rootCmd.Flags().DurationVar(&notifyTimeoutFlag, "notify.timeout", viper.GetDuration("G2T_NOTIFY_TIMEOUT"), "Timeout for posting a delivery report (G2T_NOTIFY_TIMEOUT)")
+	rootCmd.Flags().BoolVar(&sinkStdoutFlag, "sink.stdout", viper.GetBool("G2T_SINK_STDOUT"), "Mirror the alerts as JSON lines to stdout (G2T_SINK_STDOUT)")
+	rootCmd.Flags().StringVar(&sinkFileFlag, "sink.file", viper.GetString("G2T_SINK_FILE"), "File to mirror the alerts into as JSON lines (G2T_SINK_FILE)")
+	rootCmd.Flags().IntVar(&sinkFileMaxSizeFlag, "sink.file-max-size", viper.GetInt("G2T_SINK_FILE_MAX_SIZE"), "Maximum size in megabytes of the sink file before rotating it, 0 = never rotate (G2T_SINK_FILE_MAX_SIZE)")
+	rootCmd.Flags().IntVar(&sinkFileMaxBackupsFlag, "sink.file-max-backups", viper.GetInt("G2T_SINK_FILE_MAX_BACKUPS"), "Maximum number of rotated sink files to retain, 0 = all (G2T_SINK_FILE_MAX_BACKUPS)")
+	rootCmd.Flags().StringVar(&sinkWebhookFlag, "sink.webhook", viper.GetString("G2T_SINK_WEBHOOK"), "URL to mirror the alerts to via JSON POSTs (G2T_SINK_WEBHOOK)")
+	rootCmd.Flags().BoolVar(&inboundLogFlag, "inbound.log", viper.GetBool("G2T_INBOUND_LOG"), "Log the messages the recipients send to the forwarder (G2T_INBOUND_LOG)")
+	rootCmd.Flags().StringVar(&inboundWebhookFlag, "inbound.webhook", viper.GetString("G2T_INBOUND_WEBHOOK"), "URL to forward the messages the recipients send to the forwarder to via JSON POSTs (G2T_INBOUND_WEBHOOK)")
+	rootCmd.Flags().BoolVar(&inboundAckFlag, "inbound.ack", viper.GetBool("G2T_INBOUND_ACK"), "Let the recipients acknowledge alerts by replying \"ack [fingerprint]\", escalating unacked ones (G2T_INBOUND_ACK)")
+	rootCmd.Flags().BoolVar(&inboundSnoozeFlag, "inbound.snooze", viper.GetBool("G2T_INBOUND_SNOOZE"), "Let the recipients snooze alerts by replying \"snooze <duration> [fingerprint]\" (G2T_INBOUND_SNOOZE)")
+	rootCmd.Flags().DurationVar(&inboundSnoozeMaxFlag, "inbound.snooze-max", viper.GetDuration("G2T_INBOUND_SNOOZE_MAX"), "Maximum duration alerts may be snoozed for (G2T_INBOUND_SNOOZE_MAX)")
+	rootCmd.Flags().StringVar(&enrichURLFlag, "enrich.url", viper.GetString("G2T_ENRICH_URL"), "HTTP endpoint to post the alert labels to for extra context to append (G2T_ENRICH_URL)")
+	rootCmd.Flags().DurationVar(&enrichTimeoutFlag, "enrich.timeout", viper.GetDuration("G2T_ENRICH_TIMEOUT"), "Maximum time to wait for the enrichment endpoint (G2T_ENRICH_TIMEOUT)")
+	rootCmd.Flags().DurationVar(&enrichTTLFlag, "enrich.cache-ttl", viper.GetDuration("G2T_ENRICH_CACHE_TTL"), "Time to cache the enrichments of a label set for (G2T_ENRICH_CACHE_TTL)")
+	rootCmd.Flags().DurationVar(&dedupWindowFlag, "dedup.window", viper.GetDuration("G2T_DEDUP_WINDOW"), "Time window to suppress repeated fires of the same alert within, 0 = disabled (G2T_DEDUP_WINDOW)")
+	rootCmd.Flags().DurationVar(&dedupRecipientFlag, "dedup.recipient-window", viper.GetDuration("G2T_DEDUP_RECIPIENT_WINDOW"), "Time window to deliver an alert to the same recipient only once within, 0 = disabled (G2T_DEDUP_RECIPIENT_WINDOW)")
+	rootCmd.Flags().IntVar(&dedupRcptSizeFlag, "dedup.recipient-size", viper.GetInt("G2T_DEDUP_RECIPIENT_SIZE"), "Maximum number of recipient and alert pairs to track for deduplication (G2T_DEDUP_RECIPIENT_SIZE)")
+	rootCmd.Flags().IntVar(&dedupSizeFlag, "dedup.size", viper.GetInt("G2T_DEDUP_SIZE"), "Maximum number of alert fingerprints to track for deduplication (G2T_DEDUP_SIZE)")
+	rootCmd.Flags().DurationVar(&debounceFlag, "webhook.debounce", viper.GetDuration("G2T_WEBHOOK_DEBOUNCE"), "Time window to collapse byte-identical webhooks received back-to-back within, 0 = disabled (G2T_WEBHOOK_DEBOUNCE)")
+	rootCmd.Flags().DurationVar(&idempotencyWindowFlag, "idempotency.window", viper.GetDuration("G2T_IDEMPOTENCY_WINDOW"), "Time window to replay the response of retried webhooks within (0 = disabled) (G2T_IDEMPOTENCY_WINDOW)")
+	rootCmd.Flags().IntVar(&rateLimitFlag, "rate.limit", viper.GetInt("G2T_RATE_LIMIT"), "Maximum number of messages per minute to a single recipient, 0 = unlimited (G2T_RATE_LIMIT)")
+	rootCmd.Flags().StringVar(&sendOrderFlag, "send.order", viper.GetString("G2T_SEND_ORDER"), "Order to send an alert to its recipients in: listed, round-robin or random (G2T_SEND_ORDER)")
+	rootCmd.Flags().DurationVar(&batchWindowFlag, "batch.window", viper.GetDuration("G2T_BATCH_WINDOW"), "Time window to collect alerts for before sending them merged, 0 = disabled (G2T_BATCH_WINDOW)")
+	rootCmd.Flags().DurationVar(&digestIntervalFlag, "digest.interval", viper.GetDuration("G2T_DIGEST_INTERVAL"), "Interval to summarize the non-critical alerts at instead of sending them one by one, 0 = disabled (G2T_DIGEST_INTERVAL)")
+	rootCmd.Flags().BoolVar(&coalesceFlag, "coalesce", viper.GetBool("G2T_COALESCE"), "Replace held back alerts with newer ones of the same key instead of merging them (G2T_COALESCE)")
+	rootCmd.Flags().StringVar(&coalesceKeyFlag, "coalesce.key", viper.GetString("G2T_COALESCE_KEY"), "Go template deriving the coalescing key of an alert, the alert fingerprint if empty (G2T_COALESCE_KEY)")
+	rootCmd.Flags().BoolVar(&incidentTagsFlag, "incident.tags", viper.GetBool("G2T_INCIDENT_TAGS"), "Tag alerts with the incident they belong to, grouping related ones (G2T_INCIDENT_TAGS)")
+	rootCmd.Flags().StringVar(&incidentLabelFlag, "incident.label", viper.GetString("G2T_INCIDENT_LABEL"), "Label identifying the incident of an alert instead of the groupKey (G2T_INCIDENT_LABEL)")
+	rootCmd.Flags().DurationVar(&heartbeatIntervalFlag, "heartbeat.interval", viper.GetDuration("G2T_HEARTBEAT_INTERVAL"), "Interval to send a liveness message at, 0 = disabled (G2T_HEARTBEAT_INTERVAL)")
+	rootCmd.Flags().StringVar(&heartbeatToFlag, "heartbeat.to", viper.GetString("G2T_HEARTBEAT_TO"), "Threema ID(s) to send the heartbeats to, all recipients if empty (G2T_HEARTBEAT_TO)")
+	rootCmd.Flags().StringVar(&lifecycleToFlag, "lifecycle.to", viper.GetString("G2T_LIFECYCLE_TO"), "Threema ID(s) to notify when the forwarder starts and stops (G2T_LIFECYCLE_TO)")
+	rootCmd.Flags().StringVar(&lifecycleStartFlag, "lifecycle.start-message", viper.GetString("G2T_LIFECYCLE_START_MESSAGE"), "Message to send when the forwarder starts, empty to skip (G2T_LIFECYCLE_START_MESSAGE)")
+	rootCmd.Flags().StringVar(&lifecycleStopFlag, "lifecycle.stop-message", viper.GetString("G2T_LIFECYCLE_STOP_MESSAGE"), "Message to send when the forwarder shuts down gracefully, empty to skip (G2T_LIFECYCLE_STOP_MESSAGE)")
+	rootCmd.PersistentFlags().StringVar(&formatTemplateFlag, "format.template", viper.GetString("G2T_FORMAT_TEMPLATE"), "Go template file to render the messages with instead of the built-in format (G2T_FORMAT_TEMPLATE)")
+	rootCmd.PersistentFlags().StringVar(&formatTestFlag, "format.test-template", viper.GetString("G2T_FORMAT_TEST_TEMPLATE"), "Go template file to render test notifications with instead of the built-in test format (G2T_FORMAT_TEST_TEMPLATE)")
+	rootCmd.Flags().BoolVar(&debugPayloadFlag, "debug.attach-payload", viper.GetBool("G2T_DEBUG_ATTACH_PAYLOAD"), "Follow up each alert with its raw webhook payload for debugging (G2T_DEBUG_ATTACH_PAYLOAD)")
+	rootCmd.Flags().StringVar(&debugToFlag, "debug.to", viper.GetString("G2T_DEBUG_TO"), "Recipient(s) to send the raw payloads to instead of the alert's ones (G2T_DEBUG_TO)")
+	rootCmd.Flags().BoolVar(&webhookLogBodyFlag, "webhook.log-body", viper.GetBool("G2T_WEBHOOK_LOG_BODY"), "Log the raw webhook bodies before decoding them, redacted as the debug payloads (G2T_WEBHOOK_LOG_BODY)")
+	rootCmd.Flags().IntVar(&webhookLogBodyMaxFlag, "webhook.log-body-max", viper.GetInt("G2T_WEBHOOK_LOG_BODY_MAX"), "Maximum number of bytes of a raw webhook body to log, 0 = unlimited (G2T_WEBHOOK_LOG_BODY_MAX)")
+	rootCmd.Flags().StringVar(&debugRedactFlag, "debug.redact", viper.GetString("G2T_DEBUG_REDACT"), "Comma separated payload fields to mask in the raw payloads (G2T_DEBUG_REDACT)")
+	rootCmd.Flags().BoolVar(&formatStripPrefixFlag, "format.strip-prefix", viper.GetBool("G2T_FORMAT_STRIP_PREFIX"), "Strip the leading [...] state text from alert titles, as the icon conveys it (G2T_FORMAT_STRIP_PREFIX)")
+	rootCmd.Flags().StringVar(&formatLinksFlag, "format.links", viper.GetString("G2T_FORMAT_LINKS"), "Rendering of markdown links in alert messages: keep, inline as text (url), or url only (G2T_FORMAT_LINKS)")
+	rootCmd.Flags().IntVar(&formatMaxBytesFlag, "format.max-bytes", viper.GetInt("G2T_FORMAT_MAX_BYTES"), "Trim the least important parts of messages to fit this many bytes (0 = unlimited) (G2T_FORMAT_MAX_BYTES)")
+	rootCmd.Flags().IntVar(&formatMaxBodyFlag, "format.max-body-chars", viper.GetInt("G2T_FORMAT_MAX_BODY_CHARS"), "Truncate the alert message body to this many characters (0 = unlimited) (G2T_FORMAT_MAX_BODY_CHARS)")
+	rootCmd.Flags().StringVar(&formatMatchesFlag, "format.matches", viper.GetString("G2T_FORMAT_MATCHES"), "Rendering of the evaluated metrics: full list, one line summary, or none (G2T_FORMAT_MATCHES)")
+	rootCmd.Flags().StringVar(&formatNumberFlag, "format.number", viper.GetString("G2T_FORMAT_NUMBER"), "Rendering of the metric values: fixed, auto, si, bytes or a printf verb like %.3f (G2T_FORMAT_NUMBER)")
+	rootCmd.Flags().BoolVar(&formatCollapseResolvedFlag, "format.collapse-resolved", viper.GetBool("G2T_FORMAT_COLLAPSE_RESOLVED"), "Send resolved alerts as a short reference to the firing alert instead of in full (G2T_FORMAT_COLLAPSE_RESOLVED)")
+	rootCmd.Flags().BoolVar(&formatCompactFlag, "format.compact", viper.GetBool("G2T_FORMAT_COMPACT"), "Render the alerts into a single terse line instead of the full message (G2T_FORMAT_COMPACT)")
+	rootCmd.Flags().BoolVar(&formatPlainFlag, "format.plain", viper.GetBool("G2T_FORMAT_PLAIN"), "Use text labels instead of emoji icons and omit markdown emphasis (G2T_FORMAT_PLAIN)")
+	rootCmd.Flags().StringVar(&auditFileFlag, "audit.file", viper.GetString("G2T_AUDIT_FILE"), "Append-only NDJSON file to record received alerts and deliveries into (G2T_AUDIT_FILE)")
+	rootCmd.Flags().StringVar(&logFileFlag, "log.file", viper.GetString("G2T_LOG_FILE"), "File to write the logs into instead of stderr (G2T_LOG_FILE)")
+	rootCmd.Flags().BoolVar(&logStdoutFlag, "log.stdout", viper.GetBool("G2T_LOG_STDOUT"), "Also write the logs to stdout when logging into a file (G2T_LOG_STDOUT)")
+	rootCmd.Flags().BoolVar(&logDebugFlag, "log.debug", viper.GetBool("G2T_LOG_DEBUG"), "Log debug details like the timings of the send path phases (G2T_LOG_DEBUG)")
+	rootCmd.Flags().IntVar(&logMaxSizeFlag, "log.max-size", viper.GetInt("G2T_LOG_MAX_SIZE"), "Maximum size in megabytes of the log file before rotating it (G2T_LOG_MAX_SIZE)")
+	rootCmd.Flags().IntVar(&logMaxAgeFlag, "log.max-age", viper.GetInt("G2T_LOG_MAX_AGE"), "Maximum number of days to retain rotated log files, 0 = forever (G2T_LOG_MAX_AGE)")
+	rootCmd.Flags().IntVar(&logMaxBackupsFlag, "log.max-backups", viper.GetInt("G2T_LOG_MAX_BACKUPS"), "Maximum number of rotated log files to retain, 0 = all (G2T_LOG_MAX_BACKUPS)")
+	rootCmd.PersistentFlags().StringVar(&configFileFlag, "config", viper.GetString("G2T_CONFIG"), "Config file for structured settings like enrichment lookups (G2T_CONFIG)")
+	rootCmd.PersistentFlags().StringVar(&configFormatFlag, "config.format", viper.GetString("G2T_CONFIG_FORMAT"), "Format of the config file (yaml, toml or json), detected from the extension if empty (G2T_CONFIG_FORMAT)")
+	rootCmd.Flags().BoolVar(&configPrintFlag, "config.print", false, "Print the effective configuration (secrets redacted) and exit")
 
+	rootCmd.AddCommand(newIdentityCommand())
+	rootCmd.AddCommand(newValidateCommand())
+	rootCmd.AddCommand(newDoctorCommand())
 	rootCmd.Execute()
 }
 
 func forwarder(cmd *cobra.Command, args []string) {
+	setupLogging()
+
+	// Load the structured configs if a config file was specified
+	if configFileFlag != "" {
+		conf, err := readConfig(configFileFlag)
+		if err != nil {
+			fatalf(exitConfig, "Failed to load config file: %v", err)
+		}
+		loadedConfig.Store(conf)
+	}
+	// If the user only wants to see the configuration, dump it and exit
+	if configPrintFlag {
+		if err := printConfig(cmd.Flags()); err != nil {
+			fatalf(exitConfig, "Failed to print configuration: %v", err)
+		}
+		return
+	}
+	// Validate the rendering configs before doing anything heavy
+	if err := configureTime(timezoneFlag, timeFormatFlag); err != nil {
+		fatalf(exitConfig, "Failed to load timezone: %v", err)
+	}
+	if coalesceKeyFlag != "" {
+		tmpl, err := loadCoalesceKey(coalesceKeyFlag)
+		if err != nil {
+			fatalf(exitConfig, "Failed to parse coalescing key: %v", err)
+		}
+		coalesceTemplate = tmpl
+	}
+	if formatTemplateFlag != "" {
+		tmpl, err := loadTemplate(formatTemplateFlag)
+		if err != nil {
+			fatalf(exitConfig, "Failed to load message template: %v", err)
+		}
+		messageTemplate.Store(tmpl)
+	}
+	if formatTestFlag != "" {
+		tmpl, err := loadTemplate(formatTestFlag)
+		if err != nil {
+			fatalf(exitConfig, "Failed to load test template: %v", err)
+		}
+		testTemplate.Store(tmpl)
+	}
+	if auditFileFlag != "" {
+		if err := openAudit(auditFileFlag); err != nil {
+			fatalf(exitRuntime, "Failed to open audit log: %v", err)
+		}
+	}
 	// Construct the sender identity with the recipient as a contact
 	log.Println("Loading local and remote identity")
-	id, err := threema.Identify(identityFlag, passwordFlag)
+	id, err := loadIdentity(identityFlag, passwordFlag)
 	if err != nil {
-		log.Fatalf("Failed to load sender identity: %v", err)
+		fatalf(exitIdentity, "Failed to load sender identity: %v", err)
 	}
 	var (
 		tos  = strings.Split(recipientIDFlag, ",")
 		keys = strings.Split(recipientPubKeyFlag, ",")
 	)
 	if len(tos) == 0 {
-		log.Fatalf("No recpient IDs provided")
+		fatalf(exitConfig, "No recpient IDs provided")
+	}
+	if err := checkPairing(tos, keys, recipientFetchFlag); err != nil {
+		fatalf(exitConfig, "Mismatching recipient IDs and pubkeys: %v", err)
+	}
+	// Pubkeys fetched lazily are looked up at runtime, so catch a broken directory
+	// CA bundle on startup instead of on every delivery
+	if recipientFetchFlag || trustLazyFlag {
+		if _, err := directoryClient(); err != nil {
+			fatalf(exitConfig, "Failed to load directory CA: %v", err)
+		}
+	}
+	if recipientFetchFlag && !trustLazyFlag {
+		if keys, err = fetchPubkeys(tos, keys); err != nil {
+			fatalf(exitTrust, "Failed to fetch recipient pubkey: %v", err)
+		}
+	}
+	if len(keys) < len(tos) {
+		keys = append(keys, make([]string, len(tos)-len(keys))...)
+	}
+	// Collapse any duplicate recipients (e.g. from merged configs), making sure
+	// they are not configured with conflicting pubkeys
+	pubkeys := make(map[string]string)
+	for i := 0; i < len(tos); i++ {
+		if key, ok := pubkeys[tos[i]]; ok {
+			if key != keys[i] {
+				fatalf(exitConfig, "Conflicting pubkeys for duplicate recipient %s", tos[i])
+			}
+			log.Printf("Collapsing duplicate recipient %s", tos[i])
+			tos = append(tos[:i], tos[i+1:]...)
+			keys = append(keys[:i], keys[i+1:]...)
+			i--
+			continue
+		}
+		pubkeys[tos[i]] = keys[i]
+	}
+	if trustLazyFlag {
+		lazyTrust = newTruster(id, pubkeys)
+	} else {
+		for i, to := range tos {
+			if err := id.Trust(to, keys[i]); err != nil {
+				fatalf(exitTrust, "Failed to add recipient %d as contact: %v", i, err)
+			}
+		}
+	}
+	if err := validateRoutes(currentConfig().Routes, currentConfig().Fallback, tos); err != nil {
+		fatalf(exitConfig, "Invalid routing config: %v", err)
+	}
+	if err := validateEscalations(currentConfig().Escalations, tos); err != nil {
+		fatalf(exitConfig, "Invalid escalation config: %v", err)
+	}
+	// Reload the config file and message templates on SIGHUP, keeping the old
+	// ones if anything's wrong with the new versions
+	if configFileFlag != "" || formatTemplateFlag != "" || formatTestFlag != "" {
+		go func() {
+			hup := make(chan os.Signal, 1)
+			signal.Notify(hup, syscall.SIGHUP)
+			for range hup {
+				if err := reloadConfig(tos); err != nil {
+					log.Printf("Failed to reload configuration, keeping the old one: %v", err)
+					continue
+				}
+				log.Printf("Reloaded configuration")
+			}
+		}()
+	}
+	// Cross check the recipient pubkeys with the Threema directory, since a mixed
+	// up pairing would silently deliver alerts into the void
+	if recipientVerifyFlag {
+		if directoryCAFlag == "" {
+			log.Printf("Verifying recipients against the system roots, the Threema directory might need --directory.ca")
+		}
+		for i, to := range tos {
+			if keys[i] == "" {
+				continue // Fetched from the directory, nothing to verify
+			}
+			if err := verifyPubkey(to, keys[i]); err != nil {
+				log.Printf("WARNING: Failed to verify recipient %d (%s) pubkey: %v", i, to, err)
+				log.Printf("WARNING: Alerts sent to %s might not be readable by the recipient!", to)
+			}
+		}
+	}
+	// Figure out what to do with the queued alerts when shutting down
+	mode := shutdownModeFlag
+	if mode == "" {
+		mode = "flush"
+		if queueFileFlag != "" {
+			mode = "persist"
+		}
+	}
+	if mode != "flush" && mode != "persist" {
+		fatalf(exitConfig, "Unknown shutdown mode: %s", mode)
+	}
+	if mode == "persist" && queueFileFlag == "" {
+		fatalf(exitConfig, "Persist shutdown mode requires a queue file")
+	}
+	if webhookTestModeFlag != "forward" && webhookTestModeFlag != "echo" {
+		fatalf(exitConfig, "Unknown test notification mode: %s", webhookTestModeFlag)
+	}
+	if formatLinksFlag != "keep" && formatLinksFlag != "inline" && formatLinksFlag != "url" {
+		fatalf(exitConfig, "Unknown link format: %s", formatLinksFlag)
+	}
+	if formatMatchesFlag != "full" && formatMatchesFlag != "summary" && formatMatchesFlag != "none" {
+		fatalf(exitConfig, "Unknown matches format: %s", formatMatchesFlag)
+	}
+	if err := checkNumberFormat(formatNumberFlag); err != nil {
+		fatalf(exitConfig, "Invalid number format: %v", err)
+	}
+	if imageFormatFlag != "original" && imageFormatFlag != "jpeg" {
+		fatalf(exitConfig, "Unknown image format: %s", imageFormatFlag)
+	}
+	if imageQualityFlag < 1 || imageQualityFlag > 100 {
+		fatalf(exitConfig, "Invalid image quality %d, want 1-100", imageQualityFlag)
+	}
+	if imageRetriesFlag < 0 {
+		fatalf(exitConfig, "Invalid image retry count %d, want at least 0", imageRetriesFlag)
+	}
+	if imageTimeoutFlag <= 0 {
+		fatalf(exitConfig, "Invalid image timeout %v, want above 0", imageTimeoutFlag)
+	}
+	if imageMaxDownloadFlag <= 0 {
+		fatalf(exitConfig, "Invalid image download limit %d, want at least 1", imageMaxDownloadFlag)
 	}
-	if len(tos) != len(keys) {
-		log.Fatalf("Mismatchine recipient IDs and pubkeys: %d ids, %d pubkeys", len(tos), len(keys))
+	if sendOrderFlag != "listed" && sendOrderFlag != "round-robin" && sendOrderFlag != "random" {
+		fatalf(exitConfig, "Unknown send order: %s", sendOrderFlag)
 	}
-	for i, to := range tos {
-		if err := id.Trust(to, keys[i]); err != nil {
-			log.Fatalf("Failed to add recipient %d as contact: %v", i, err)
+	if formatMaxBytesFlag < 0 || (formatMaxBytesFlag > 0 && formatMaxBytesFlag < len("…")) {
+		fatalf(exitConfig, "Invalid message size limit %d, want 0 or at least %d", formatMaxBytesFlag, len("…"))
+	}
+	if dedupSizeFlag <= 0 {
+		fatalf(exitConfig, "Invalid dedup size %d, want at least 1", dedupSizeFlag)
+	}
+	if dedupRcptSizeFlag <= 0 {
+		fatalf(exitConfig, "Invalid recipient dedup size %d, want at least 1", dedupRcptSizeFlag)
+	}
+	// If lifecycle notices were requested, ensure the recipients are known
+	var lifecycleTos []string
+	if lifecycleToFlag != "" {
+		lifecycleTos = strings.Split(lifecycleToFlag, ",")
+		for _, to := range lifecycleTos {
+			if !contains(tos, to) {
+				fatalf(exitConfig, "Lifecycle recipient %s is not a configured recipient", to)
+			}
+		}
+	}
+	// If a fallback for alerts without recipients was requested, ensure it's known
+	if recipientEmptyFlag != "" {
+		orphanTos = strings.Split(recipientEmptyFlag, ",")
+		for _, to := range orphanTos {
+			if !contains(tos, to) {
+				fatalf(exitConfig, "Empty recipient fallback %s is not a configured recipient", to)
+			}
 		}
 	}
 	// Start the publisher goroutine to feed alerts to Threema
-	alerts := make(chan *alert)
-	go publisher(id, tos, alerts)
-
-	// Create a forwarder REST service that accepts Grafana webhook POSTs,
-	// converts them into Threema messages and relays them to the recipient.
-	http.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
-		// Retrieve the alert from the Grafana notification
-		event := new(struct {
-			State   string `json:"state"`
-			Title   string `json:"title"`
-			Message string `json:"message"`
-			Image   string `json:"imageUrl"`
-			Link    string `json:"ruleUrl"`
-			Matches []struct {
-				Metric string  `json:"metric"`
-				Value  float64 `json:"value"`
-			} `json:"evalMatches"`
+	var (
+		alerts = make(chan *alert, alertQueueSize)
+		stop   = make(chan struct{})
+		done   = make(chan struct{})
+	)
+	retries, err := newRetryQueue(retryFileFlag)
+	if err != nil {
+		fatalf(exitRuntime, "Failed to load retry queue: %v", err)
+	}
+	sinks, err := newSinks(sinkStdoutFlag, sinkFileFlag, sinkWebhookFlag)
+	if err != nil {
+		fatalf(exitRuntime, "Failed to create alert sinks: %v", err)
+	}
+	inboundActions = newInboundActions(inboundLogFlag, inboundWebhookFlag)
+	if inboundSnoozeFlag {
+		snoozes = newSnoozer(inboundSnoozeMaxFlag)
+		inboundActions = append(inboundActions, snoozes.handle)
+	}
+	if inboundAckFlag {
+		escalations = newEscalator()
+		inboundActions = append(inboundActions, escalations.handle)
+	}
+	var (
+		held    []*alert
+		active  uint32
+		started sync.Once
+	)
+	promote := func() {
+		started.Do(func() {
+			log.Println("Starting alert publisher")
+			atomic.StoreUint32(&active, 1)
+			go func() {
+				held = supervisePublisher(id, tos, alerts, stop, retries, sinks)
+				close(done)
+			}()
+			if lifecycleTos != nil && lifecycleStartFlag != "" {
+				log.Println("Queueing startup notice")
+				alerts <- &alert{message: lifecycleStartFlag, tos: lifecycleTos, queued: time.Now()}
+			}
+			// If alerts were persisted by a previous run, queue them up for delivery
+			if queueFileFlag != "" {
+				pending, err := loadQueue(queueFileFlag)
+				if err != nil {
+					fatalf(exitRuntime, "Failed to load persisted alerts: %v", err)
+				}
+				if len(pending) > 0 {
+					log.Printf("Requeueing %d persisted alerts", len(pending))
+				}
+				for _, alert := range pending {
+					alerts <- alert
+				}
+			}
 		})
-		if err := json.NewDecoder(req.Body).Decode(event); err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
+	}
+	// If running as a standby, hold the alerts until promoted to active
+	switch {
+	case leaderLockFlag != "":
+		log.Printf("Waiting for leadership via %s", leaderLockFlag)
+		go func() {
+			if err := awaitLeadership(leaderLockFlag); err != nil {
+				fatalf(exitRuntime, "Failed to acquire leader lock: %v", err)
+			}
+			log.Println("Acquired leadership")
+			promote()
+		}()
+	case !standbyFlag:
+		promote()
+	default:
+		log.Printf("Running in standby mode, %s", promoteHint)
+		go func() {
+			if !awaitPromoteSignal() {
+				return
+			}
+			log.Println("Promotion requested via signal")
+			promote()
+		}()
+	}
+
+	// If heartbeats were requested, periodically prove that we're alive
+	var (
+		quit      = make(chan struct{})
+		producers sync.WaitGroup
+	)
+	if heartbeatIntervalFlag > 0 {
+		var beats []string
+		if heartbeatToFlag != "" {
+			beats = strings.Split(heartbeatToFlag, ",")
+			for _, beat := range beats {
+				if !contains(tos, beat) {
+					fatalf(exitConfig, "Heartbeat recipient %s is not a configured recipient", beat)
+				}
+			}
 		}
-		// If an image was attached, try to download it
-		var (
-			image    []byte
-			imageErr error
-		)
-		if len(event.Image) != 0 {
-			res, err := http.Get(event.Image)
-			if err != nil {
-				imageErr = err
+		producers.Add(1)
+		go func() {
+			defer producers.Done()
+			heartbeat(heartbeatIntervalFlag, beats, alerts, quit)
+		}()
+	}
+	// If snoozing was requested, send the confirmations back to the recipients
+	if snoozes != nil {
+		producers.Add(1)
+		go func() {
+			defer producers.Done()
+			snoozes.relay(alerts, quit)
+		}()
+	}
+	// If acknowledgements were requested, escalate the alerts nobody acked
+	if escalations != nil {
+		producers.Add(1)
+		go func() {
+			defer producers.Done()
+			escalations.run(alerts, quit)
+		}()
+	}
+	// Queueing an alert blocks while the queue is full, make sure the handlers
+	// bail out instead of hanging if the publisher is gone, the forwarder is
+	// shutting down or the sender left
+	enqueue := func(req *http.Request, alert *alert) bool {
+		select {
+		case alerts <- alert:
+			return true
+		case <-done:
+			log.Printf("Publisher exited, rejecting alert")
+			return false
+		case <-quit:
+			log.Printf("Forwarder shutting down, rejecting alert")
+			return false
+		case <-req.Context().Done():
+			if errors.Is(req.Context().Err(), context.DeadlineExceeded) {
+				log.Printf("Handler timed out while queueing alert")
 			} else {
-				image, imageErr = ioutil.ReadAll(res.Body)
-				res.Body.Close()
+				log.Printf("Webhook sender left while queueing alert")
 			}
+			return false
 		}
-		// Prepare the alert message
-		var icon string
-		switch event.State {
-		case "alerting":
-			icon = "🔥"
-			if strings.HasPrefix(event.Title, "[Alerting]") {
-				event.Title = event.Title[10:]
-			}
-		case "ok":
-			icon = "☘️"
-			if strings.HasPrefix(event.Title, "[OK]") {
-				event.Title = event.Title[4:]
-			}
-		default:
-			icon = event.State
+	}
+	// If the admin UI was requested, expose it for sending manual messages
+	if adminUIFlag {
+		if adminUserFlag == "" || adminSecretFlag == "" {
+			fatalf(exitConfig, "Admin UI requires both a username and a password")
 		}
-		message := "*" + icon + " " + event.Title + "*\n\n"
-		if imageErr != nil {
-			message = message + "Failed to attach image: " + imageErr.Error() + "\n\n"
+		http.Handle("/admin/send", newAdminHandler(adminUserFlag, adminSecretFlag, tos, enqueue))
+		http.Handle("/admin/promote", newPromoteHandler(adminUserFlag, adminSecretFlag, promote))
+	}
+
+	// If payload debugging was requested, ensure the debug recipients are known
+	var debugTos []string
+	if debugToFlag != "" {
+		debugTos = strings.Split(debugToFlag, ",")
+		for _, to := range debugTos {
+			if !contains(tos, to) {
+				fatalf(exitConfig, "Debug recipient %s is not a configured recipient", to)
+			}
 		}
-		message = message + event.Message + "\n\n"
+	}
+	// Bound each image download, so a stalled or huge response can't hang the
+	// handler or exhaust the memory
+	imageClient.Timeout = imageTimeoutFlag
+
+	// If image downloads are limited, create the semaphore to wait on
+	if imageMaxConcurrentFlag > 0 {
+		imageSlots = make(chan struct{}, imageMaxConcurrentFlag)
+	}
 
-		for _, item := range event.Matches {
-			message = message + fmt.Sprintf("*%s*: _%.2f_\n", item.Metric, item.Value)
+	// If deduplication was requested, track the fingerprints of firing alerts
+	var dedup *deduplicator
+	if dedupWindowFlag > 0 {
+		dedup = newDeduplicator(dedupWindowFlag, dedupSizeFlag)
+	}
+	// If debouncing was requested, track the hashes of the recent webhook bodies
+	var debounce *deduplicator
+	if debounceFlag > 0 {
+		debounce = newDeduplicator(debounceFlag, dedupSizeFlag)
+	}
+	// If remote enrichment was requested, create the client to look them up with
+	enricher := newRemoteEnricher(enrichURLFlag, enrichTimeoutFlag, enrichTTLFlag)
+
+	// If resolutions are to be collapsed, track when the alerts started firing
+	var firings *firingTracker
+	if formatCollapseResolvedFlag {
+		firings = newFiringTracker()
+	}
+	// If grouping was requested, track the incidents the alerts belong to
+	var incidents *incidentTracker
+	if incidentTagsFlag {
+		incidents = newIncidentTracker()
+	}
+	// Create the webhook handler converting Grafana notifications into Threema
+	// messages, queueing them for the publisher
+	webhook := &webhookHandler{
+		tos:        tos,
+		debugTos:   debugTos,
+		queue:      alerts,
+		enqueue:    enqueue,
+		dedup:      dedup,
+		debounce:   debounce,
+		enricher:   enricher,
+		firings:    firings,
+		incidents:  incidents,
+		imageTypes: strings.Split(imageTypesFlag, ","),
+	}
+	// If retry safety was requested, replay the responses of retried webhooks
+	var idempotency *idempotencyCache
+	if idempotencyWindowFlag > 0 {
+		idempotency = newIdempotencyCache(idempotencyWindowFlag, maxIdempotencyKeys)
+	}
+	if err := checkWebhookPath(webhookPathFlag); err != nil {
+		fatalf(exitConfig, "Invalid webhook path: %v", err)
+	}
+	inflight := limitInflight(webhookInflightFlag, webhookRetryAfterFlag)
+	http.HandleFunc(webhookPathFlag, exactPath(webhookPathFlag, inflight(authenticate(idempotency.wrap(webhook.ServeHTTP), webhookTokenFlag, webhookHMACFlag))))
+	for _, endpoint := range currentConfig().Endpoints {
+		if err := checkWebhookPath(endpoint.Path); err != nil {
+			fatalf(exitConfig, "Invalid endpoint path: %v", err)
 		}
-		if len(event.Matches) > 0 {
-			message = message + "\n"
+		if endpoint.Path == webhookPathFlag {
+			fatalf(exitConfig, "Endpoint path %s clashes with the webhook path", endpoint.Path)
+		}
+		var (
+			token  = webhookTokenFlag
+			secret = webhookHMACFlag
+		)
+		if endpoint.Token != "" || endpoint.HMACSecret != "" {
+			if token, err = resolveSecret(endpoint.Token); err != nil {
+				fatalf(exitConfig, "Failed to resolve token of endpoint %s: %v", endpoint.Path, err)
+			}
+			if secret, err = resolveSecret(endpoint.HMACSecret); err != nil {
+				fatalf(exitConfig, "Failed to resolve HMAC secret of endpoint %s: %v", endpoint.Path, err)
+			}
 		}
-		message = message + event.Link
+		log.Printf("Accepting webhooks on %s", endpoint.Path)
+		http.HandleFunc(endpoint.Path, exactPath(endpoint.Path, inflight(authenticate(idempotency.wrap(webhook.ServeHTTP), token, secret))))
+	}
+	http.Handle("/metrics", newMetricsHandler(alerts, func() bool { return atomic.LoadUint32(&active) == 1 }))
+	http.HandleFunc("/healthz", healthHandler)
+	http.HandleFunc("/readyz", readyHandler)
+
+	listeners, err := listen(listenFlag)
+	if err != nil {
+		fatalf(exitListen, "Failed to open listener: %v", err)
+	}
+	// Track the running handlers, since they may outlive a timed out shutdown of
+	// the server and the alert queue can't be closed while they might feed it
+	var handlers sync.WaitGroup
+	server := &http.Server{Handler: trackHandlers(&handlers, http.DefaultServeMux)}
+	for _, listener := range listeners {
+		log.Printf("Listening for webhooks on %s", listener.Addr())
+		go func(listener net.Listener) {
+			if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+				fatalf(exitListen, "Failed to serve webhooks: %v", err)
+			}
+		}(listener)
+	}
+	// Wait until the process is asked to terminate and shut down gracefully
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
+	<-sigc
+
+	log.Printf("Shutting down forwarder (mode %s)", mode)
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownGraceFlag)
+	defer cancel()
 
-		// Queue the message for Threema publishing
-		alerts <- &alert{
-			message: message,
-			image:   image,
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Failed to shut down webhook server: %v", err)
+	}
+	close(quit)
+	producers.Wait()
+
+	// Wait for any lingering handlers, they bail out of queueing on quit, but
+	// might still be downloading images
+	finished := make(chan struct{})
+	go func() {
+		handlers.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-ctx.Done():
+		log.Printf("Webhook handlers failed to terminate within grace period")
+	}
+	// If requested, say goodbye, unless the queue is about to be persisted or
+	// the forwarder never got to deliver anything
+	if lifecycleTos != nil && lifecycleStopFlag != "" && mode != "persist" && atomic.LoadUint32(&active) == 1 {
+		log.Println("Queueing shutdown notice")
+		select {
+		case alerts <- &alert{message: lifecycleStopFlag, tos: lifecycleTos, queued: time.Now()}:
+		case <-ctx.Done():
+			log.Printf("Failed to queue shutdown notice within grace period")
+		}
+	}
+	// No more alerts can arrive, either deliver or persist the queued ones. A
+	// standby that was never promoted has nothing running to wait for. If some
+	// handlers are still running, the queue can't be closed under them, so the
+	// publisher is stopped instead, persisting whatever's left.
+	started.Do(func() { close(done) })
+	select {
+	case <-finished:
+		if mode == "persist" {
+			close(stop)
 		}
-	})
-	http.ListenAndServe("0.0.0.0:8000", nil)
+		close(alerts)
+	default:
+		close(stop)
+	}
+	// The publisher still owns the held alerts and the queue until it returns. If
+	// it's stuck, give up on them instead of racing it for the same alerts.
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Printf("Publisher failed to terminate within grace period, abandoning undelivered alerts")
+		return
+	}
+	if pending := append(held, drainQueue(alerts)...); len(pending) > 0 {
+		if queueFileFlag == "" {
+			log.Printf("Dropping %d undelivered alerts", len(pending))
+			return
+		}
+		log.Printf("Persisting %d undelivered alerts", len(pending))
+		if err := saveQueue(queueFileFlag, pending); err != nil {
+			log.Printf("Failed to persist undelivered alerts: %v", err)
+		}
+	}
 }
 
 // alert is a helper struct to feed alerts over a channel to the publisher.
 type alert struct {
-	message string // Message content of the alert, always present
-	image   []byte // Image content of the alert, optional
+	message     string    // Message content of the alert, always present
+	images      [][]byte  // Image contents of the alert, optional
+	tos         []string  // Recipients of the alert, all configured ones if nil, none if empty
+	severity    string    // Severity label of the alert, optional
+	key         string    // Coalescing key, pending alerts with the same one are replaced
+	fingerprint string    // Fingerprint of the Grafana alert, empty for internal messages
+	state       string    // State of the Grafana alert, empty for internal messages
+	queued      time.Time // Timestamp when the alert was queued for delivery
 }
 
-// publisher is an indefinite goroutine that keeps waiting for incoming alerts
-// and publishes them over Threema. It's simpler to run a separate goroutine as
-// it lower the number of reconnects in simultaneous alerts and also avoids the
-// concurrency caused by the HTTP handler.
-func publisher(id *threema.Identity, tos []string, alerts chan *alert) {
-	for {
-		// Wait for the next alert to arrive
-		alert := <-alerts
-
-		// Connect to the Threema network and send the alert message, looping
-		// if a new one arrived in the meantime.
-		log.Println("Connecting to the Threema network")
-		conn, err := threema.Connect(id, new(threema.Handler)) // Ignore message
-		if err != nil {
-			log.Printf("Failed to connect to the Threema network: %v", err)
-			continue // Alert lost - c'est la vie - maybe we'll succeed next time
-		}
-		for alert != nil {
-			// Send the alert to all recipients
-			for _, to := range tos {
-				log.Printf("Sending alert message to %s", to)
-				if len(alert.image) > 0 {
-					if err := conn.SendImage(to, alert.image, alert.message); err != nil {
-						log.Printf("Failed to send alert image: %v", err)
-						continue // Alert lost - c'est la vie - maybe we'll succeed for the next user
-					}
-				} else {
-					if err := conn.SendText(to, alert.message); err != nil {
-						log.Printf("Failed to send alert message: %v", err)
-						continue // Alert lost - c'est la vie - maybe we'll succeed for the next user
-					}
-				}
-				log.Println("Alert message sent")
-			}
-			// Check if there are more alerts queued up
-			select {
-			case alert = <-alerts:
-			default:
-				alert = nil
-			}
+// contains reports whether a string is present in a list.
+func contains(list []string, item string) bool {
+	for _, have := range list {
+		if have == item {
+			return true
 		}
-		// All alerts queued up have been sent, disconnect
-		conn.Close()
 	}
+	return false
 }
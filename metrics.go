@@ -0,0 +1,197 @@
+// Copyright 2021 Péter Szilágyi. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	alertsReceived      uint64 // Number of alerts accepted for delivery
+	deliveriesSucceeded uint64 // Number of alerts successfully sent to a recipient
+	deliveriesFailed    uint64 // Number of failed attempts at sending an alert
+	webhooksOverloaded  uint64 // Number of webhooks rejected over the in-flight limit
+	threemaReachable    uint32 // Connectivity to the Threema network: 0 = unknown, 1 = up, 2 = down
+
+	alertsDropped     = make(map[string]uint64) // Number of deliberately dropped alerts, by reason
+	alertsDroppedLock sync.Mutex
+
+	threemaReconnects     = make(map[string]uint64) // Number of connections to the Threema network, by reason
+	threemaReconnectsLock sync.Mutex
+
+	// Durations of the phases of the send path, to tell apart slow connection
+	// setups, a slow Threema network and slow image renders
+	phaseConnect = newHistogram() // Time to connect to the Threema network
+	phaseSend    = newHistogram() // Time to send an alert to a single recipient
+	phaseImage   = newHistogram() // Time to download a single alert image
+)
+
+// histogramBuckets are the upper bounds in seconds of the latency histograms.
+var histogramBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// histogram is a minimal Prometheus style cumulative latency histogram.
+type histogram struct {
+	counts []uint64 // Number of observations below each bucket bound
+	count  uint64   // Total number of observations
+	sum    float64  // Sum of all the observations in seconds
+	lock   sync.Mutex
+}
+
+// newHistogram creates an empty latency histogram.
+func newHistogram() *histogram {
+	return &histogram{counts: make([]uint64, len(histogramBuckets))}
+}
+
+// observe records a measured duration into the histogram.
+func (h *histogram) observe(d time.Duration) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	secs := d.Seconds()
+	for i, bound := range histogramBuckets {
+		if secs <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += secs
+}
+
+// write dumps the histogram series in the Prometheus text format.
+func (h *histogram) write(w io.Writer, name string, phase string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	for i, bound := range histogramBuckets {
+		fmt.Fprintf(w, "%s_bucket{phase=%q,le=\"%g\"} %d\n", name, phase, bound, h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{phase=%q,le=\"+Inf\"} %d\n", name, phase, h.count)
+	fmt.Fprintf(w, "%s_sum{phase=%q} %g\n", name, phase, h.sum)
+	fmt.Fprintf(w, "%s_count{phase=%q} %d\n", name, phase, h.count)
+}
+
+// countDropped records a deliberately dropped alert for the metrics.
+func countDropped(reason string) {
+	alertsDroppedLock.Lock()
+	defer alertsDroppedLock.Unlock()
+
+	alertsDropped[reason]++
+}
+
+// countReconnect records a connection attempt to the Threema network for the
+// metrics.
+func countReconnect(reason string) {
+	threemaReconnectsLock.Lock()
+	defer threemaReconnectsLock.Unlock()
+
+	threemaReconnects[reason]++
+}
+
+// setReachable records the outcome of the last connectivity signal from the
+// Threema network.
+func setReachable(up bool) {
+	if up {
+		atomic.StoreUint32(&threemaReachable, 1)
+	} else {
+		atomic.StoreUint32(&threemaReachable, 2)
+	}
+}
+
+// newMetricsHandler creates an HTTP handler that exposes the internal counters
+// of the forwarder in the Prometheus text format.
+func newMetricsHandler(alerts chan *alert, active func() bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+		fmt.Fprintf(w, "# HELP g2t_alerts_received_total Number of alerts accepted for delivery.\n")
+		fmt.Fprintf(w, "# TYPE g2t_alerts_received_total counter\n")
+		fmt.Fprintf(w, "g2t_alerts_received_total %d\n", atomic.LoadUint64(&alertsReceived))
+
+		fmt.Fprintf(w, "# HELP g2t_alerts_dropped_total Number of alerts deliberately not forwarded.\n")
+		fmt.Fprintf(w, "# TYPE g2t_alerts_dropped_total counter\n")
+		alertsDroppedLock.Lock()
+		reasons := make([]string, 0, len(alertsDropped))
+		for reason := range alertsDropped {
+			reasons = append(reasons, reason)
+		}
+		sort.Strings(reasons)
+		for _, reason := range reasons {
+			fmt.Fprintf(w, "g2t_alerts_dropped_total{reason=%q} %d\n", reason, alertsDropped[reason])
+		}
+		alertsDroppedLock.Unlock()
+
+		fmt.Fprintf(w, "# HELP g2t_deliveries_total Number of attempts at sending an alert to a recipient.\n")
+		fmt.Fprintf(w, "# TYPE g2t_deliveries_total counter\n")
+		fmt.Fprintf(w, "g2t_deliveries_total{status=\"delivered\"} %d\n", atomic.LoadUint64(&deliveriesSucceeded))
+		fmt.Fprintf(w, "g2t_deliveries_total{status=\"failed\"} %d\n", atomic.LoadUint64(&deliveriesFailed))
+
+		fmt.Fprintf(w, "# HELP g2t_threema_reconnects_total Number of connection attempts to the Threema network, by reason.\n")
+		fmt.Fprintf(w, "# TYPE g2t_threema_reconnects_total counter\n")
+		threemaReconnectsLock.Lock()
+		reasons = reasons[:0]
+		for reason := range threemaReconnects {
+			reasons = append(reasons, reason)
+		}
+		sort.Strings(reasons)
+		for _, reason := range reasons {
+			fmt.Fprintf(w, "g2t_threema_reconnects_total{reason=%q} %d\n", reason, threemaReconnects[reason])
+		}
+		threemaReconnectsLock.Unlock()
+
+		fmt.Fprintf(w, "# HELP g2t_webhooks_overloaded_total Number of webhooks rejected over the in-flight limit.\n")
+		fmt.Fprintf(w, "# TYPE g2t_webhooks_overloaded_total counter\n")
+		fmt.Fprintf(w, "g2t_webhooks_overloaded_total %d\n", atomic.LoadUint64(&webhooksOverloaded))
+
+		fmt.Fprintf(w, "# HELP g2t_phase_duration_seconds Duration of the phases of the send path.\n")
+		fmt.Fprintf(w, "# TYPE g2t_phase_duration_seconds histogram\n")
+		phaseConnect.write(w, "g2t_phase_duration_seconds", "connect")
+		phaseSend.write(w, "g2t_phase_duration_seconds", "send")
+		phaseImage.write(w, "g2t_phase_duration_seconds", "image")
+
+		fmt.Fprintf(w, "# HELP g2t_idempotency_replays_total Number of retried webhooks answered from the cache.\n")
+		fmt.Fprintf(w, "# TYPE g2t_idempotency_replays_total counter\n")
+		fmt.Fprintf(w, "g2t_idempotency_replays_total %d\n", atomic.LoadUint64(&idempotencyReplays))
+
+		fmt.Fprintf(w, "# HELP g2t_queued_alerts Number of alerts waiting for the publisher.\n")
+		fmt.Fprintf(w, "# TYPE g2t_queued_alerts gauge\n")
+		fmt.Fprintf(w, "g2t_queued_alerts %d\n", len(alerts))
+
+		if reachable := atomic.LoadUint32(&threemaReachable); reachable != 0 {
+			fmt.Fprintf(w, "# HELP g2t_threema_reachable Whether the last connection attempt to the Threema network succeeded.\n")
+			fmt.Fprintf(w, "# TYPE g2t_threema_reachable gauge\n")
+			fmt.Fprintf(w, "g2t_threema_reachable %d\n", 2-reachable)
+		}
+
+		var standby int
+		if !active() {
+			standby = 1
+		}
+		fmt.Fprintf(w, "# HELP g2t_standby Whether the forwarder is a standby not delivering alerts.\n")
+		fmt.Fprintf(w, "# TYPE g2t_standby gauge\n")
+		fmt.Fprintf(w, "g2t_standby %d\n", standby)
+	})
+}
+
+// healthHandler reports that the forwarder is up and serving requests.
+func healthHandler(w http.ResponseWriter, req *http.Request) {
+	w.Write([]byte("OK\n"))
+}
+
+// readyHandler reports whether the forwarder is able to deliver alerts, i.e. the
+// Threema network was reachable on the last attempt. Until the first attempt the
+// connectivity is unknown and the forwarder is assumed ready.
+func readyHandler(w http.ResponseWriter, req *http.Request) {
+	if atomic.LoadUint32(&threemaReachable) == 2 {
+		http.Error(w, "Threema network unreachable", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("OK\n"))
+}
@@ -0,0 +1,56 @@
+// Copyright 2021 Péter Szilágyi. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+// deliveryReport is the JSON payload posted to the notification webhook after
+// each attempt at delivering an alert to a recipient.
+type deliveryReport struct {
+	Recipient string  `json:"recipient"`
+	Status    string  `json:"status"`
+	Error     string  `json:"error,omitempty"`
+	Latency   float64 `json:"latency"` // Seconds
+	Time      string  `json:"time"`
+}
+
+// notifyDelivery reports the outcome of an alert delivery to the configured
+// notification webhook, if any. The report is posted on a background goroutine
+// so a slow or dead webhook never blocks the publisher.
+func notifyDelivery(to string, err error, latency time.Duration) {
+	if notifyWebhookFlag == "" {
+		return
+	}
+	report := &deliveryReport{
+		Recipient: to,
+		Status:    "delivered",
+		Latency:   latency.Seconds(),
+		Time:      time.Now().UTC().Format(time.RFC3339),
+	}
+	if err != nil {
+		report.Status = "failed"
+		report.Error = err.Error()
+	}
+	go func() {
+		blob, err := json.Marshal(report)
+		if err != nil {
+			log.Printf("Failed to encode delivery report: %v", err)
+			return
+		}
+		client := &http.Client{Timeout: notifyTimeoutFlag}
+		res, err := client.Post(notifyWebhookFlag, "application/json", bytes.NewReader(blob))
+		if err != nil {
+			log.Printf("Failed to post delivery report: %v", err)
+			return
+		}
+		res.Body.Close()
+	}()
+}
@@ -0,0 +1,118 @@
+// Copyright 2021 Péter Szilágyi. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// oncallEvent is the payload sent by Grafana OnCall's outgoing webhooks. Only
+// the fields relevant for a chat notification are decoded.
+type oncallEvent struct {
+	Event struct {
+		Type string `json:"type"` // escalation, acknowledge, resolve, silence, ...
+	} `json:"event"`
+	User       *oncallUser `json:"user"` // User triggering the event, if any
+	AlertGroup *struct {
+		ID         string `json:"id"`
+		State      string `json:"state"` // firing, acknowledged, resolved, silenced
+		Title      string `json:"title"`
+		Alerts     int    `json:"alerts_count"`
+		Permalinks struct {
+			Web string `json:"web"`
+		} `json:"permalinks"`
+	} `json:"alert_group"`
+	AlertPayload json.RawMessage `json:"alert_payload"`
+	Integration  struct {
+		Name string `json:"name"`
+	} `json:"integration"`
+	Notified []*oncallUser `json:"users_to_be_notified"`
+}
+
+// oncallUser is a user referenced by a Grafana OnCall webhook.
+type oncallUser struct {
+	Username string `json:"username"`
+}
+
+// oncallStates maps the alert group states of Grafana OnCall to the alert states
+// of Grafana, so dedup, routing and incident tracking treat them alike.
+var oncallStates = map[string]string{
+	"firing":   "alerting",
+	"resolved": "ok",
+}
+
+// parseOnCall tries to interpret a JSON payload as a Grafana OnCall webhook,
+// reporting whether it has the OnCall schema (an alert group with an id).
+func parseOnCall(blob []byte) (*grafanaEvent, bool) {
+	oncall := new(oncallEvent)
+	if err := json.Unmarshal(blob, oncall); err != nil || oncall.AlertGroup == nil || oncall.AlertGroup.ID == "" {
+		return nil, false
+	}
+	return oncall.event(), true
+}
+
+// event converts the Grafana OnCall webhook into a Grafana event. The original
+// alert forwarded by OnCall (if it came from Grafana) supplies the message,
+// images and labels, while the escalation details are prepended to it.
+//
+// OnCall does not include one-click action URLs in its webhooks, so the alert
+// group's web permalink is surfaced as the link to acknowledge or resolve it.
+func (oncall *oncallEvent) event() *grafanaEvent {
+	event := new(grafanaEvent)
+	if len(oncall.AlertPayload) > 0 {
+		json.Unmarshal(oncall.AlertPayload, event) // Best effort, payload may be anything
+	}
+	group := oncall.AlertGroup
+
+	event.RuleName = oncall.Integration.Name
+	event.GroupKey = group.ID
+	event.Title = group.Title
+	event.Link = group.Permalinks.Web
+
+	event.State = group.State
+	if state, ok := oncallStates[group.State]; ok {
+		event.State = state
+	}
+	// Describe what OnCall is doing with the alert group
+	var lines []string
+	switch oncall.Event.Type {
+	case "escalation":
+		if names := oncallUsernames(oncall.Notified); names != "" {
+			lines = append(lines, "Escalating to "+names)
+		} else {
+			lines = append(lines, "Escalating")
+		}
+	case "acknowledge", "resolve", "silence", "unacknowledge", "unresolve", "unsilence":
+		line := strings.ToUpper(oncall.Event.Type[:1]) + oncall.Event.Type[1:] + "d"
+		if oncall.User != nil && oncall.User.Username != "" {
+			line += " by " + oncall.User.Username
+		}
+		lines = append(lines, line)
+	}
+	if group.Alerts > 1 {
+		lines = append(lines, fmt.Sprintf("%d alerts in group", group.Alerts))
+	}
+	if group.State == "firing" && event.Link != "" {
+		lines = append(lines, "Open the link to acknowledge or resolve")
+	}
+	if event.Message != "" {
+		lines = append(lines, "", event.Message)
+	}
+	event.Message = strings.Join(lines, "\n")
+	return event
+}
+
+// oncallUsernames joins the names of the given OnCall users for display.
+func oncallUsernames(users []*oncallUser) string {
+	var names []string
+	for _, user := range users {
+		if user != nil && user.Username != "" {
+			names = append(names, user.Username)
+		}
+	}
+	return strings.Join(names, ", ")
+}
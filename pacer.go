@@ -0,0 +1,164 @@
+// Copyright 2021 Péter Szilágyi. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"log"
+	"strings"
+	"time"
+)
+
+// recipientConfig is the per recipient delivery configuration, overriding the
+// global settings for a single Threema ID.
+type recipientConfig struct {
+	ID          string          `mapstructure:"id" json:"id"`
+	RateLimit   *int            `mapstructure:"rate-limit" json:"rate-limit,omitempty"`
+	BatchWindow time.Duration   `mapstructure:"batch-window" json:"batch-window,omitempty"`
+	Schedule    *scheduleConfig `mapstructure:"schedule" json:"schedule,omitempty"`
+}
+
+// pacing defines how fast alerts may be delivered to a recipient.
+type pacing struct {
+	rate   int           // Maximum number of messages per minute, 0 = unlimited
+	window time.Duration // Time to collect alerts for before sending them merged
+
+	schedule *scheduleConfig // Hours the recipient is active in, always if nil
+}
+
+// recipientPacing retrieves the delivery pacing of a recipient, defaulting to
+// the global settings if no override is configured.
+func recipientPacing(to string) pacing {
+	pace := pacing{
+		rate:   rateLimitFlag,
+		window: batchWindowFlag,
+	}
+	for _, rcpt := range currentConfig().Recipients {
+		if rcpt.ID != to {
+			continue
+		}
+		if rcpt.RateLimit != nil {
+			pace.rate = *rcpt.RateLimit
+		}
+		if rcpt.BatchWindow != 0 {
+			pace.window = rcpt.BatchWindow
+		}
+		pace.schedule = rcpt.Schedule
+	}
+	return pace
+}
+
+// pacer holds back the alerts of a single recipient until its rate limit and
+// batch window allow them to be sent, merging them together in the meantime.
+type pacer struct {
+	pace    pacing
+	pending []*alert    // Alerts waiting to be delivered
+	since   time.Time   // Arrival time of the oldest pending alert
+	sent    []time.Time // Delivery times within the last minute
+}
+
+// newPacer creates a pacer for a recipient with the given pacing.
+func newPacer(pace pacing) *pacer {
+	return &pacer{pace: pace}
+}
+
+// offDuty reports whether the recipient is outside of its active schedule, and if
+// so, whether the alerts should be dropped instead of held back.
+func (p *pacer) offDuty(now time.Time) (off bool, drop bool) {
+	if p.pace.schedule == nil || p.pace.schedule.active(now) {
+		return false, false
+	}
+	return true, p.pace.schedule.OffHours == "drop"
+}
+
+// paced reports whether alerts to this recipient need to be held back at all.
+func (p *pacer) paced() bool {
+	return p.pace.rate > 0 || p.pace.window > 0
+}
+
+// add queues up an alert for paced delivery. If an alert with the same
+// coalescing key is already pending, it is replaced by the new one.
+func (p *pacer) add(alert *alert, now time.Time) {
+	if alert.key != "" {
+		for i, pending := range p.pending {
+			if pending.key == alert.key {
+				p.pending[i] = alert
+				return
+			}
+		}
+	}
+	if len(p.pending) == 0 {
+		p.since = now
+	}
+	p.pending = append(p.pending, alert)
+}
+
+// due returns the pending alerts merged into a single one if the batch window
+// elapsed, the rate limit allows a new message and the recipient is on duty (or
+// if forced regardless of the pacing), or nil otherwise.
+func (p *pacer) due(now time.Time, force bool) *alert {
+	if force {
+		return p.flush()
+	}
+	if off, _ := p.offDuty(now); off {
+		return nil
+	}
+	if len(p.pending) == 0 || now.Sub(p.since) < p.pace.window {
+		return nil
+	}
+	if p.pace.rate > 0 {
+		for len(p.sent) > 0 && now.Sub(p.sent[0]) >= time.Minute {
+			p.sent = p.sent[1:]
+		}
+		if len(p.sent) >= p.pace.rate {
+			return nil
+		}
+		p.sent = append(p.sent, now)
+	}
+	return p.flush()
+}
+
+// flush returns the pending alerts merged into a single one, regardless of the
+// pacing, or nil if there's nothing pending.
+func (p *pacer) flush() *alert {
+	if len(p.pending) == 0 {
+		return nil
+	}
+	merged := mergeAlerts(p.pending)
+	p.pending = nil
+	return merged
+}
+
+// mergeAlerts combines multiple alerts into a single one, concatenating their
+// messages and images. If requested, the images are composed into a single grid,
+// falling back to sending them separately if that fails.
+func mergeAlerts(alerts []*alert) *alert {
+	if len(alerts) == 1 {
+		return alerts[0]
+	}
+	merged := &alert{queued: alerts[0].queued}
+
+	messages := make([]string, 0, len(alerts))
+	for _, alert := range alerts {
+		messages = append(messages, alert.message)
+		merged.images = append(merged.images, alert.images...)
+		if alert.severity == "critical" {
+			merged.severity = alert.severity
+		}
+		if alert.queued.Before(merged.queued) {
+			merged.queued = alert.queued
+		}
+	}
+	merged.message = strings.Join(messages, "\n\n---\n\n")
+
+	if imageGridFlag && len(merged.images) > 1 {
+		grid, err := composeGrid(merged.images)
+		if err != nil {
+			log.Printf("Failed to compose image grid, sending separately: %v", err)
+		} else {
+			merged.images = [][]byte{grid}
+		}
+	}
+	return merged
+}
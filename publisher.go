@@ -0,0 +1,553 @@
+// Copyright 2021 Péter Szilágyi. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+
+	"github.com/karalabe/go-threema"
+)
+
+// delivery is a single alert to be sent to a single recipient.
+type delivery struct {
+	to       string
+	alert    *alert
+	attempts int // Number of previously failed attempts
+}
+
+// publisher is an indefinite goroutine that keeps waiting for incoming alerts
+// and publishes them over Threema. It's simpler to run a separate goroutine as
+// it lower the number of reconnects in simultaneous alerts and also avoids the
+// concurrency caused by the HTTP handler.
+//
+// Recipients with paced delivery (rate limits or batching) have their alerts
+// held back and merged until they are allowed to receive a new message.
+//
+// Every alert is also mirrored into the secondary sinks, if any are configured.
+// The sinks are fed in the background, so they never delay the deliveries, and
+// failures there are only logged, Threema being the primary output.
+//
+// Failed deliveries are scheduled into the retry queue, and reattempted with an
+// exponential backoff until they succeed or run out of attempts.
+//
+// If warm-up was requested, the connection to the Threema network is established
+// on startup and kept open between alerts, reconnecting in the background if it
+// drops, so that alerts don't have to wait for the handshake.
+//
+// The publisher terminates when the alert channel is closed and drained, or when
+// the stop channel is closed, leaving any remaining alerts in the channel. Paced
+// alerts still held back are flushed in the former case and returned in the
+// latter case.
+func publisher(id *threema.Identity, tos []string, alerts chan *alert, stop chan struct{}, retries *retryQueue, sinks []sink) []*alert {
+	paced := loadedConfig.Load() // Config the pacing was resolved from, to detect reloads
+
+	pacers := make(map[string]*pacer)
+	for _, to := range tos {
+		pacers[to] = newPacer(recipientPacing(to))
+	}
+	var dedup *deduplicator
+	if dedupRecipientFlag > 0 {
+		dedup = newDeduplicator(dedupRecipientFlag, dedupRcptSizeFlag)
+	}
+	var digest *digester
+	if digestIntervalFlag > 0 {
+		digest = newDigester(digestIntervalFlag, time.Now())
+	}
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	var (
+		conn     sender        // Live connection, only kept open between bursts if warm
+		connDown chan struct{} // Channel closed when the live connection terminates
+		lastDial time.Time     // Time of the last connection attempt, to throttle warm-ups
+		lastSent time.Time     // Time of the last successful send, to recycle idle connections
+		turn     int           // Number of alerts fanned out, to rotate the recipients by
+		reason   = "startup"   // Reason the next connection is needed, for churn metrics
+	)
+	if standbyFlag || leaderLockFlag != "" {
+		reason = "failover"
+	}
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+	for {
+		// Drop the connection if it was severed, reestablishing it if warm
+		if conn != nil {
+			select {
+			case <-connDown:
+				log.Println("Connection to the Threema network lost")
+				conn, reason = nil, "lost"
+				setReachable(false)
+			default:
+			}
+		}
+		// If a warm connection sat idle for too long, recycle it before a NAT or a
+		// firewall silently drops it. The library's own echo heartbeat is fixed to
+		// 3 minutes and there's no exported ping, so reconnect instead.
+		if connWarmupFlag && connPingFlag > 0 && conn != nil && time.Since(lastDial) >= connPingFlag && time.Since(lastSent) >= connPingFlag {
+			log.Println("Recycling idle connection to the Threema network")
+			conn.Close()
+			<-connDown
+			conn, reason, lastDial = nil, "recycle", time.Time{}
+		}
+		if connWarmupFlag && conn == nil && time.Since(lastDial) >= warmupRetryInterval {
+			log.Printf("Warming up connection to the Threema network (%s)", reason)
+
+			var err error
+			lastDial = time.Now()
+			if conn, connDown, err = connect(id, reason); err != nil {
+				log.Printf("Failed to warm up Threema connection: %v", err)
+			}
+		}
+		// If health checks were requested, probe the network when not connected,
+		// keeping the connection if warm (reconnecting proactively after outages)
+		if connHealthFlag > 0 && conn == nil && time.Since(lastDial) >= connHealthFlag {
+			debugf("Checking connectivity to the Threema network")
+
+			lastDial = time.Now()
+			probe, probeDown, err := connect(id, "health")
+			switch {
+			case err != nil:
+				log.Printf("Threema connectivity check failed: %v", err)
+			case connWarmupFlag:
+				conn, connDown = probe, probeDown
+			default:
+				probe.Close()
+			}
+		}
+		// Wait for the next alert to arrive, or for a paced batch to become due
+		var (
+			alert  *alert
+			closed bool
+		)
+		select {
+		case <-stop:
+		case alert = <-alerts:
+			closed = alert == nil
+		case <-ticker.C:
+		}
+		// Stopping takes precedence over everything, hand back what's held
+		select {
+		case <-stop:
+			held := holdBack(pacers)
+			if digest != nil {
+				held = append(held, digest.flush(time.Now())...)
+			}
+			if alert != nil {
+				held = append(held, alert)
+			}
+			return held
+		default:
+		}
+		// If the config was reloaded, switch the pacers over to the new recipient
+		// pacing, keeping the alerts already held back and the send history
+		if conf := loadedConfig.Load(); conf != paced {
+			for to, pacer := range pacers {
+				pacer.pace = recipientPacing(to)
+			}
+			paced = conf
+		}
+		// Connect to the Threema network and send the due alert messages, looping
+		// if new ones arrived in the meantime.
+		for {
+			// Gather all the deliveries that can be done right now
+			var (
+				now     = time.Now()
+				batches []*delivery
+			)
+			if alert != nil {
+				for _, sink := range sinks {
+					if err := sink.send(alert); err != nil {
+						log.Printf("Failed to mirror alert into sink: %v", err)
+					}
+				}
+			}
+			if alert != nil && !expired(alert) {
+				rcpts := orderRecipients(alertRecipients(tos, alert), sendOrderFlag, turn)
+				turn++
+
+				for _, to := range rcpts {
+					if dedup != nil && !dedup.deliver(to, alert, now) {
+						log.Printf("Collapsing duplicate alert to %s", to)
+						countDropped("duplicate")
+						continue
+					}
+					if snoozes.snoozed(to, alert, now) {
+						log.Printf("Withholding alert snoozed by %s", to)
+						countDropped("snoozed")
+						continue
+					}
+					if pacer, ok := pacers[to]; ok && alert.fingerprint != "" {
+						if off, drop := pacer.offDuty(now); off && drop {
+							log.Printf("Dropping alert to off duty recipient %s", to)
+							countDropped("off-duty")
+							continue
+						} else if off {
+							log.Printf("Holding back alert to off duty recipient %s", to)
+							pacer.add(alert, now)
+							continue
+						}
+					}
+					if digest != nil && digest.accepts(alert) {
+						digest.add(to, alert)
+						continue
+					}
+					if pacer, ok := pacers[to]; ok && pacer.paced() {
+						pacer.add(alert, now)
+						continue
+					}
+					batches = append(batches, &delivery{to: to, alert: alert})
+				}
+			}
+			for to, pacer := range pacers {
+				if batch := pacer.due(now, closed); batch != nil {
+					batches = append(batches, &delivery{to: to, alert: batch})
+				}
+			}
+			if digest != nil {
+				batches = append(batches, digest.due(now, closed)...)
+			}
+			if closed && drainTimeoutFlag > 0 {
+				// Draining patiently, reattempt all the scheduled retries too
+				batches = append(batches, retries.due(now.Add(retryMaxBackoffFlag))...)
+			} else {
+				batches = append(batches, retries.due(now)...)
+			}
+
+			// If recipients are trusted lazily, add any new ones as contacts. The
+			// contacts can't change under a live connection, so drop it first.
+			if lazyTrust != nil {
+				for _, batch := range batches {
+					if lazyTrust.untrusted(batch.to) && conn != nil {
+						log.Println("Disconnecting to trust new recipients")
+						conn.Close()
+						<-connDown
+						conn, reason = nil, "trust"
+					}
+				}
+				trusted := batches[:0]
+				for _, batch := range batches {
+					if err := lazyTrust.trust(batch.to); err != nil {
+						log.Printf("Failed to trust recipient %s: %v", batch.to, err)
+						reportDelivery(batch, err, 0)
+						retries.schedule(batch, now)
+						continue
+					}
+					trusted = append(trusted, batch)
+				}
+				batches = trusted
+			}
+			// If there's anything to send, make sure we're connected and send it
+			if len(batches) > 0 && conn == nil {
+				log.Printf("Connecting to the Threema network (%s)", reason)
+
+				var err error
+				lastDial = now
+				if conn, connDown, err = connect(id, reason); err != nil {
+					log.Printf("Failed to connect to the Threema network: %v", err)
+					if !closed || drainTimeoutFlag == 0 {
+						for _, batch := range batches {
+							reportDelivery(batch, err, 0)
+							retries.schedule(batch, now)
+						}
+						break // Maybe we'll succeed next time
+					}
+				}
+			}
+			for _, batch := range batches {
+				if expired(batch.alert) {
+					continue
+				}
+				log.Printf("Sending alert message to %s", batch.to)
+				start := time.Now()
+
+				err := errNotConnected
+				if conn != nil {
+					err = deliver(conn, batch.to, batch.alert)
+				}
+				if err != nil && closed && drainTimeoutFlag > 0 {
+					log.Printf("Failed to send alert message while draining: %v", err)
+					conn, connDown, err = deliverPatiently(id, conn, connDown, batch)
+				}
+				phaseSend.observe(time.Since(start))
+				debugf("Sending alert message to %s took %v", batch.to, time.Since(start))
+
+				if err != nil {
+					log.Printf("Failed to send alert message: %v", err)
+					reportDelivery(batch, err, time.Since(start))
+					retries.schedule(batch, time.Now())
+					continue // Maybe we'll succeed for the next user
+				}
+				log.Println("Alert message sent")
+				lastSent = time.Now()
+				reportDelivery(batch, nil, time.Since(start))
+			}
+			// Check if there are more alerts queued up, unless stopping or closed
+			if closed {
+				break
+			}
+			select {
+			case <-stop:
+				alert = nil
+			default:
+				select {
+				case alert = <-alerts:
+					closed = alert == nil
+				default:
+					alert = nil
+				}
+			}
+			if alert == nil && !closed {
+				break
+			}
+		}
+		// All alerts queued up have been sent, disconnect unless kept warm
+		if conn != nil && !connWarmupFlag {
+			conn.Close()
+			conn, reason = nil, "idle"
+		}
+		if closed {
+			return nil
+		}
+	}
+}
+
+// holdBack gathers all the alerts still held back by the pacers, addressing
+// each of them explicitly to the recipient it was held back for.
+func holdBack(pacers map[string]*pacer) []*alert {
+	var held []*alert
+	for to, pacer := range pacers {
+		if batch := pacer.flush(); batch != nil {
+			addressed := *batch
+			addressed.tos = []string{to}
+			held = append(held, &addressed)
+		}
+	}
+	return held
+}
+
+// orphanTos are the recipients to deliver alerts explicitly addressed to nobody
+// to, nil if such alerts are to be dropped.
+var orphanTos []string
+
+// alertRecipients returns the recipients an alert should be delivered to: the
+// ones explicitly requested by the alert, or all the configured ones if it has
+// none set. Duplicate recipients are collapsed so nobody gets the same alert
+// twice.
+//
+// An alert requesting an empty list of recipients (e.g. all its dynamically
+// resolved ones filtered out) is not broadcast to everyone, rather delivered to
+// the fallback recipients if any, or dropped otherwise.
+func alertRecipients(tos []string, alert *alert) []string {
+	if alert.tos == nil {
+		return tos
+	}
+	if len(alert.tos) == 0 {
+		if orphanTos == nil {
+			log.Printf("WARNING: Dropping alert without any recipients")
+			countDropped("no-recipients")
+			return nil
+		}
+		log.Printf("WARNING: Alert has no recipients, delivering to the fallback")
+		return orphanTos
+	}
+	var (
+		unique = make([]string, 0, len(alert.tos))
+		seen   = make(map[string]bool)
+	)
+	for _, to := range alert.tos {
+		if seen[to] {
+			log.Printf("Collapsing duplicate alert recipient %s", to)
+			continue
+		}
+		seen[to] = true
+		unique = append(unique, to)
+	}
+	return unique
+}
+
+// shuffler is the randomness source for the random send order. It's only used by
+// the publisher goroutine, so it doesn't need to be thread safe.
+var shuffler = rand.New(rand.NewSource(time.Now().UnixNano()))
+
+// orderRecipients arranges the recipients of an alert in the order they should be
+// sent to. Since sending is serial, the first recipients always get an alert a
+// bit sooner, so the order can be rotated by the alert's turn (round-robin) or
+// shuffled (random) to spread the delay fairly. The input is never modified.
+func orderRecipients(tos []string, order string, turn int) []string {
+	if len(tos) < 2 {
+		return tos
+	}
+	ordered := make([]string, 0, len(tos))
+	switch order {
+	case "round-robin":
+		shift := turn % len(tos)
+		ordered = append(append(ordered, tos[shift:]...), tos[:shift]...)
+	case "random":
+		ordered = append(ordered, tos...)
+		shuffler.Shuffle(len(ordered), func(i, j int) { ordered[i], ordered[j] = ordered[j], ordered[i] })
+	default:
+		ordered = append(ordered, tos...)
+	}
+	return ordered
+}
+
+// deliver sends a single alert to a single recipient over an established Threema
+// connection. If the alert has images attached, the first one is sent with the
+// alert text as its caption, and the rest are sent as follow-ups without one.
+//
+// If the image cannot be sent, the alert falls back to a text message, so the
+// content still reaches the recipient even if the image path is broken.
+func deliver(conn sender, to string, alert *alert) error {
+	if len(alert.images) == 0 {
+		return conn.SendText(to, alert.message)
+	}
+	if err := conn.SendImage(to, alert.images[0], alert.message); err != nil {
+		log.Printf("Failed to send alert image, falling back to text: %v", err)
+		if err := conn.SendText(to, alert.message+"\n\nFailed to send image: "+err.Error()); err != nil {
+			log.Printf("Failed to send text fallback: %v", err)
+			return err
+		}
+		log.Printf("Text fallback sent")
+		return nil
+	}
+	for _, image := range alert.images[1:] {
+		if err := conn.SendImage(to, image, ""); err != nil {
+			log.Printf("Failed to send extra alert image: %v", err)
+		}
+	}
+	return nil
+}
+
+// reportDelivery records the outcome of a delivery attempt into the metrics, the
+// audit log and the delivery notification webhook.
+func reportDelivery(batch *delivery, err error, latency time.Duration) {
+	if err != nil {
+		atomic.AddUint64(&deliveriesFailed, 1)
+	} else {
+		atomic.AddUint64(&deliveriesSucceeded, 1)
+	}
+	auditDelivery(batch, err)
+	notifyDelivery(batch.to, err, latency)
+}
+
+// errNotConnected is returned if a delivery is attempted without a connection.
+var errNotConnected = errors.New("not connected to the Threema network")
+
+// drainRetryDelay is the time to wait between delivery attempts while draining.
+const drainRetryDelay = time.Second
+
+// deliverPatiently keeps retrying a failed delivery on shutdown, reconnecting to
+// the Threema network before each attempt, until it either succeeds or the
+// drain timeout elapses. The live connection is returned, nil if there's none.
+func deliverPatiently(id *threema.Identity, conn sender, down chan struct{}, batch *delivery) (sender, chan struct{}, error) {
+	var (
+		deadline = time.Now().Add(drainTimeoutFlag)
+		err      = errNotConnected
+	)
+	for time.Now().Add(drainRetryDelay).Before(deadline) {
+		time.Sleep(drainRetryDelay)
+		if conn != nil {
+			conn.Close()
+		}
+		if conn, down, err = connect(id, "send-error"); err != nil {
+			log.Printf("Failed to reconnect to the Threema network: %v", err)
+			continue
+		}
+		if err = deliver(conn, batch.to, batch.alert); err == nil {
+			return conn, down, nil
+		}
+		log.Printf("Failed to send alert message while draining: %v", err)
+	}
+	return conn, down, err
+}
+
+// sender is the backend delivering the messages to the recipients, implemented
+// by a live Threema connection.
+type sender interface {
+	// SendText sends a text message to a recipient.
+	SendText(to string, text string) error
+
+	// SendImage sends an image with an optional caption to a recipient.
+	SendImage(to string, image []byte, caption string) error
+
+	// Close tears down the connection.
+	Close() error
+}
+
+// dialer establishes the connections the publisher sends the messages through.
+// It can be swapped out (e.g. for a fake recording the sends) to exercise the
+// delivery pipeline without the Threema network.
+var dialer = dial
+
+// connect dials the Threema network, counting the reason why a new connection
+// was needed (startup, failover, idle, lost, recycle, trust, health or
+// send-error), to tell the causes of connection churn apart.
+//
+// The outcome of the attempt is recorded as the connectivity status of the Threema
+// network for the readiness check.
+func connect(id *threema.Identity, reason string) (sender, chan struct{}, error) {
+	countReconnect(reason)
+
+	conn, down, err := dialer(id)
+	setReachable(err == nil)
+	return conn, down, err
+}
+
+// warmupRetryInterval is the time to wait between attempts at reestablishing a
+// warm connection to the Threema network.
+const warmupRetryInterval = 30 * time.Second
+
+// dial connects to the Threema network, dispatching any inbound messages to the
+// configured actions. The returned channel is closed when the connection
+// terminates.
+func dial(id *threema.Identity) (sender, chan struct{}, error) {
+	start := time.Now()
+	down := make(chan struct{})
+	conn, err := threema.Connect(id, newInboundHandler(func() { close(down) }))
+	phaseConnect.observe(time.Since(start))
+	debugf("Connecting to the Threema network took %v", time.Since(start))
+	if err != nil {
+		return nil, nil, err
+	}
+	return conn, down, nil
+}
+
+// supervisePublisher runs the publisher, restarting it if it panics, so that a
+// single bad alert cannot permanently break forwarding. The alert being sent
+// when the panic occurred is lost, but the retry queue and the queued alerts
+// survive.
+func supervisePublisher(id *threema.Identity, tos []string, alerts chan *alert, stop chan struct{}, retries *retryQueue, sinks []sink) []*alert {
+	for {
+		held, err := runPublisher(id, tos, alerts, stop, retries, sinks)
+		if err == nil {
+			return held
+		}
+		log.Printf("Publisher crashed, restarting: %v", err)
+		time.Sleep(publisherRestartDelay)
+	}
+}
+
+// publisherRestartDelay is the time to wait before restarting a crashed
+// publisher, avoiding a hot loop if it keeps crashing.
+const publisherRestartDelay = time.Second
+
+// runPublisher runs the publisher, converting a panic into an error.
+func runPublisher(id *threema.Identity, tos []string, alerts chan *alert, stop chan struct{}, retries *retryQueue, sinks []sink) (held []*alert, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v\n%s", r, debug.Stack())
+		}
+	}()
+	return publisher(id, tos, alerts, stop, retries, sinks), nil
+}
@@ -0,0 +1,128 @@
+// Copyright 2021 Péter Szilágyi. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+)
+
+// alertQueueSize is the number of alerts that may be waiting for the publisher
+// before the HTTP handlers start blocking.
+const alertQueueSize = 1024
+
+// storedAlert is the on-disk representation of an alert that was persisted to
+// survive a restart of the forwarder.
+type storedAlert struct {
+	Message  string    `json:"message"`
+	Images   [][]byte  `json:"images,omitempty"`
+	Tos      []string  `json:"tos"` // Not omitted, empty and nil mean different things
+	Severity string    `json:"severity,omitempty"`
+	Key      string    `json:"key,omitempty"`
+	Print    string    `json:"fingerprint,omitempty"`
+	State    string    `json:"state,omitempty"`
+	Queued   time.Time `json:"queued"`
+}
+
+// storeAlert converts an alert into its on-disk representation.
+func storeAlert(alert *alert) *storedAlert {
+	return &storedAlert{
+		Message:  alert.message,
+		Images:   alert.images,
+		Tos:      alert.tos,
+		Severity: alert.severity,
+		Key:      alert.key,
+		Print:    alert.fingerprint,
+		State:    alert.state,
+		Queued:   alert.queued,
+	}
+}
+
+// restore converts a persisted alert back into its in-memory representation.
+func (s *storedAlert) restore() *alert {
+	return &alert{
+		message:     s.Message,
+		images:      s.Images,
+		tos:         s.Tos,
+		severity:    s.Severity,
+		key:         s.Key,
+		fingerprint: s.Print,
+		state:       s.State,
+		queued:      s.Queued,
+	}
+}
+
+// expired reports whether an alert waited in the queue for longer than allowed,
+// and should be dropped instead of delivered stale. Critical alerts may be
+// exempt from expiration.
+func expired(alert *alert) bool {
+	if queueMaxAgeFlag == 0 || alert.queued.IsZero() || (queueKeepCritFlag && alert.severity == "critical") {
+		return false
+	}
+	if age := time.Since(alert.queued); age > queueMaxAgeFlag {
+		log.Printf("Dropping stale alert queued at %s (%s ago)", formatTime(alert.queued), formatDuration(age))
+		return true
+	}
+	return false
+}
+
+// drainQueue retrieves all the alerts currently waiting in the queue, without
+// blocking for new ones to arrive.
+func drainQueue(alerts chan *alert) []*alert {
+	var pending []*alert
+	for {
+		select {
+		case alert, ok := <-alerts:
+			if !ok {
+				return pending
+			}
+			pending = append(pending, alert)
+		default:
+			return pending
+		}
+	}
+}
+
+// saveQueue persists a batch of undelivered alerts into the given file, so a
+// subsequent run of the forwarder can pick them up. The file is replaced
+// atomically to avoid leaving a truncated batch behind on a crash.
+func saveQueue(path string, alerts []*alert) error {
+	stored := make([]*storedAlert, 0, len(alerts))
+	for _, alert := range alerts {
+		stored = append(stored, storeAlert(alert))
+	}
+	blob, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path+".tmp", blob, 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// loadQueue retrieves a batch of alerts persisted by a previous run of the
+// forwarder and deletes the file so they are not delivered twice.
+func loadQueue(path string) ([]*alert, error) {
+	blob, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var stored []*storedAlert
+	if err := json.Unmarshal(blob, &stored); err != nil {
+		return nil, err
+	}
+	alerts := make([]*alert, 0, len(stored))
+	for _, item := range stored {
+		alerts = append(alerts, item.restore())
+	}
+	return alerts, os.Remove(path)
+}
@@ -0,0 +1,55 @@
+// Copyright 2021 Péter Szilágyi. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import "time"
+
+// receivedAlert is the normalized representation of an alert received via a
+// webhook, independent of the schema it arrived in (Grafana, Grafana OnCall,
+// form fields or custom field extraction). The decoders produce one, and the
+// rest of the pipeline (dedup, routing, severity, templating) works off it,
+// until it's rendered into an alert for the publisher.
+type receivedAlert struct {
+	ruleID   int64  // Grafana alert rule id, zero if unknown
+	ruleName string // Grafana alert rule name, or the OnCall integration name
+	groupKey string // Grafana notification group or OnCall alert group
+
+	state    string            // Alert state (alerting, ok, acknowledged, ...)
+	severity string            // Severity from the payload, empty to resolve it from the labels
+	title    string            // Title of the alert, may be empty
+	message  string            // Message body of the alert, may be empty
+	link     string            // Link to the alert rule or alert group
+	labels   map[string]string // Legacy tags and unified alerting labels merged
+	matches  []*matchData      // Metric values that triggered the alert
+	images   []*imageSource    // Images to attach to the alert
+
+	fingerprint string    // Stable identifier of the alert rule and label set
+	payload     []byte    // Raw payload the alert was decoded from
+	received    time.Time // Time the alert was received
+}
+
+// normalize converts a decoded Grafana event into the internal alert model,
+// resolving the images to attach and the alert's fingerprint.
+func (event *grafanaEvent) normalize(payload []byte, received time.Time) *receivedAlert {
+	alert := &receivedAlert{
+		ruleID:   event.RuleID,
+		ruleName: event.RuleName,
+		groupKey: event.GroupKey,
+		state:    event.State,
+		severity: event.Severity,
+		title:    event.Title,
+		message:  event.Message,
+		link:     event.Link,
+		labels:   event.labels(),
+		images:   event.imageSources(imageRenderWidthFlag, imageRenderHeightFlag),
+		payload:  payload,
+		received: received,
+	}
+	for _, item := range event.Matches {
+		alert.matches = append(alert.matches, &matchData{Metric: item.Metric, Value: item.Value})
+	}
+	alert.fingerprint = fingerprint(alert)
+	return alert
+}
@@ -0,0 +1,45 @@
+// Copyright 2021 Péter Szilágyi. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import "testing"
+
+// Tests that Grafana and Grafana OnCall payloads are normalized into the same
+// alert model, with the fingerprint independent of the alert's state.
+func TestParseEventNormalizes(t *testing.T) {
+	firing, err := parseEvent([]byte(`{"ruleId":7,"ruleName":"CPU","state":"alerting","title":"CPU high","tags":{"host":"a"},"commonLabels":{"severity":"critical"},"evalMatches":[{"metric":"load","value":4.2}],"imageUrl":"http://grafana/a.png"}`))
+	if err != nil {
+		t.Fatalf("failed to parse firing alert: %v", err)
+	}
+	if firing.state != "alerting" || firing.title != "CPU high" || firing.ruleID != 7 {
+		t.Errorf("alert mismatch: have %+v", firing)
+	}
+	if firing.labels["host"] != "a" || firing.labels["severity"] != "critical" {
+		t.Errorf("labels mismatch: have %v", firing.labels)
+	}
+	if len(firing.matches) != 1 || firing.matches[0].Metric != "load" || firing.matches[0].Value != 4.2 {
+		t.Errorf("matches mismatch: have %v", firing.matches)
+	}
+	if len(firing.images) != 1 || firing.images[0].url != "http://grafana/a.png" {
+		t.Errorf("images mismatch: have %v", firing.images)
+	}
+	if firing.received.IsZero() || len(firing.payload) == 0 {
+		t.Errorf("receipt details missing")
+	}
+	resolved, err := parseEvent([]byte(`{"ruleId":7,"ruleName":"CPU","state":"ok","title":"CPU high","tags":{"host":"a"},"commonLabels":{"severity":"critical"}}`))
+	if err != nil {
+		t.Fatalf("failed to parse resolved alert: %v", err)
+	}
+	if resolved.fingerprint != firing.fingerprint {
+		t.Errorf("fingerprint changed on resolution: have %s, want %s", resolved.fingerprint, firing.fingerprint)
+	}
+	oncall, err := parseEvent([]byte(`{"event":{"type":"escalation"},"alert_group":{"id":"G1","state":"firing","title":"Disk full"},"integration":{"name":"Storage"}}`))
+	if err != nil {
+		t.Fatalf("failed to parse OnCall alert: %v", err)
+	}
+	if oncall.state != "alerting" || oncall.title != "Disk full" || oncall.groupKey != "G1" || oncall.ruleName != "Storage" {
+		t.Errorf("OnCall alert mismatch: have %+v", oncall)
+	}
+}
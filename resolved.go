@@ -0,0 +1,65 @@
+// Copyright 2021 Péter Szilágyi. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// maxFirings is the number of firing alerts to remember the start of before new
+// ones are not tracked any more. It's a safety net against alerts never resolving.
+const maxFirings = 1024
+
+// firingTracker remembers when the currently firing alerts started, so their
+// resolution can be collapsed into a short reference to the original alert.
+//
+// Ideally the resolution would be a reply quoting the firing message, but the
+// Threema library doesn't expose the IDs of the sent messages, which quotes
+// need, so a standalone message is sent instead.
+type firingTracker struct {
+	fired map[string]time.Time // Start of the firing alerts, keyed by fingerprint
+	lock  sync.Mutex
+}
+
+// newFiringTracker creates a tracker without any firing alerts.
+func newFiringTracker() *firingTracker {
+	return &firingTracker{
+		fired: make(map[string]time.Time),
+	}
+}
+
+// fire records that an alert is firing, keeping the start of the first fire if
+// it's repeated.
+func (t *firingTracker) fire(fingerprint string, when time.Time) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if _, ok := t.fired[fingerprint]; ok || len(t.fired) >= maxFirings {
+		return
+	}
+	t.fired[fingerprint] = when
+}
+
+// resolve forgets a resolved alert, returning when it started firing, or the
+// zero time if it's unknown (e.g. it fired before a restart).
+func (t *firingTracker) resolve(fingerprint string) time.Time {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	fired := t.fired[fingerprint]
+	delete(t.fired, fingerprint)
+	return fired
+}
+
+// formatResolved renders the collapsed form of a resolved alert, a single line
+// referencing the original alert and how long it was firing for, if known.
+func formatResolved(data *messageData, fired time.Time, now time.Time) string {
+	message := styled("title", data.Icon+" "+data.Tag+"Resolved: "+data.Title)
+	if !fired.IsZero() {
+		message += "\n\nFiring since " + formatTime(fired) + " (" + formatDuration(now.Sub(fired)) + ")"
+	}
+	return message
+}
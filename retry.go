@@ -0,0 +1,125 @@
+// Copyright 2021 Péter Szilágyi. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"time"
+)
+
+// retryEntry is a failed delivery waiting for its next attempt.
+type retryEntry struct {
+	To       string       `json:"to"`
+	Alert    *storedAlert `json:"alert"`
+	Attempts int          `json:"attempts"`
+	Next     time.Time    `json:"next"`
+}
+
+// retryQueue tracks the failed deliveries, ordered by their next attempt time.
+// If backed by a file, the queue is persisted on every change so a restart of
+// the forwarder resumes the backoff schedule instead of retrying everything at
+// once (or losing the alerts altogether).
+//
+// The queue is not thread safe, it's meant to be used by the publisher only.
+type retryQueue struct {
+	path    string        // File to persist the queue into, empty for memory only
+	entries []*retryEntry // Failed deliveries, ordered by next attempt time
+}
+
+// newRetryQueue creates a retry queue, loading any deliveries persisted into the
+// backing file by a previous run.
+func newRetryQueue(path string) (*retryQueue, error) {
+	queue := &retryQueue{path: path}
+	if path == "" {
+		return queue, nil
+	}
+	blob, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return queue, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(blob, &queue.entries); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(queue.entries, func(i, j int) bool {
+		return queue.entries[i].Next.Before(queue.entries[j].Next)
+	})
+	return queue, nil
+}
+
+// schedule queues up a failed delivery for a later attempt, backing off
+// exponentially with the number of failures. If the delivery failed too many
+// times already, it is dropped.
+func (q *retryQueue) schedule(failed *delivery, now time.Time) {
+	attempts := failed.attempts + 1
+	if attempts > retryMaxFlag {
+		log.Printf("Dropping alert to %s after %d failed attempts", failed.to, attempts)
+		return
+	}
+	backoff := retryBackoffFlag << (attempts - 1)
+	if backoff > retryMaxBackoffFlag || backoff <= 0 {
+		backoff = retryMaxBackoffFlag
+	}
+	entry := &retryEntry{
+		To:       failed.to,
+		Alert:    storeAlert(failed.alert),
+		Attempts: attempts,
+		Next:     now.Add(backoff),
+	}
+	index := sort.Search(len(q.entries), func(i int) bool {
+		return q.entries[i].Next.After(entry.Next)
+	})
+	q.entries = append(q.entries, nil)
+	copy(q.entries[index+1:], q.entries[index:])
+	q.entries[index] = entry
+
+	log.Printf("Retrying alert to %s in %s (attempt %d/%d)", failed.to, formatDuration(backoff), attempts, retryMaxFlag)
+	q.save()
+}
+
+// due removes and returns all the deliveries whose next attempt time arrived.
+func (q *retryQueue) due(now time.Time) []*delivery {
+	var deliveries []*delivery
+	for len(q.entries) > 0 && !q.entries[0].Next.After(now) {
+		entry := q.entries[0]
+		q.entries = q.entries[1:]
+
+		deliveries = append(deliveries, &delivery{
+			to:       entry.To,
+			alert:    entry.Alert.restore(),
+			attempts: entry.Attempts,
+		})
+	}
+	if len(deliveries) > 0 {
+		q.save()
+	}
+	return deliveries
+}
+
+// save persists the retry queue into its backing file, if any. The file is
+// replaced atomically to avoid corrupting it on a crash.
+func (q *retryQueue) save() {
+	if q.path == "" {
+		return
+	}
+	blob, err := json.Marshal(q.entries)
+	if err != nil {
+		log.Printf("Failed to encode retry queue: %v", err)
+		return
+	}
+	if err := ioutil.WriteFile(q.path+".tmp", blob, 0600); err != nil {
+		log.Printf("Failed to persist retry queue: %v", err)
+		return
+	}
+	if err := os.Rename(q.path+".tmp", q.path); err != nil {
+		log.Printf("Failed to persist retry queue: %v", err)
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2021 Péter Szilágyi. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// stateRoute directs the alerts of a given state to a subset of the recipients,
+// e.g. to page the on-call engineer with failures, but only notify the team of
+// recoveries.
+type stateRoute struct {
+	State string   `mapstructure:"state" json:"state"`
+	To    []string `mapstructure:"to" json:"to"`
+}
+
+// fallbackRoute is the catch-all route for alerts matching none of the routes,
+// making the default of delivering them to everyone explicit and configurable.
+// Since an unrouted alert usually means a gap in the routing rules, it can be
+// logged loudly and reported to an admin too.
+type fallbackRoute struct {
+	To     []string `mapstructure:"to" json:"to,omitempty"`         // Recipients of unrouted alerts, all if empty
+	Warn   bool     `mapstructure:"warn" json:"warn,omitempty"`     // Whether to log a warning for unrouted alerts
+	Notify []string `mapstructure:"notify" json:"notify,omitempty"` // Recipients to notify about unrouted alerts
+}
+
+// validateRoutes ensures that all the routes (and the fallback) point to the
+// configured recipients, as the contacts need to be trusted up front.
+func validateRoutes(routes []*stateRoute, fallback *fallbackRoute, tos []string) error {
+	for _, route := range routes {
+		if len(route.To) == 0 {
+			return fmt.Errorf("route for state %q has no recipients", route.State)
+		}
+		for _, to := range route.To {
+			if !contains(tos, to) {
+				return fmt.Errorf("route for state %q has unknown recipient %s", route.State, to)
+			}
+		}
+	}
+	if fallback != nil {
+		for _, to := range append(fallback.To, fallback.Notify...) {
+			if !contains(tos, to) {
+				return fmt.Errorf("fallback route has unknown recipient %s", to)
+			}
+		}
+	}
+	return nil
+}
+
+// payloadRecipients retrieves the recipients an alert explicitly requests via its
+// `threema_to` label (comma separated Threema IDs), overriding the routing, or
+// nil if there's no such label. Recipients not configured on startup are only
+// accepted if they can be trusted on the fly (pubkey fetched from the directory),
+// otherwise they are skipped.
+func payloadRecipients(labels map[string]string, tos []string, lazy bool) []string {
+	value, ok := labels["threema_to"]
+	if !ok {
+		return nil
+	}
+	var rcpts []string
+	for _, to := range strings.Split(value, ",") {
+		to = strings.ToUpper(strings.TrimSpace(to))
+		switch {
+		case to == "":
+		case !threemaIDPattern.MatchString(to):
+			log.Printf("Skipping malformed payload recipient %q", to)
+		case !contains(tos, to) && !lazy:
+			log.Printf("Skipping unknown payload recipient %s, requires lazy trust", to)
+		default:
+			rcpts = append(rcpts, to)
+		}
+	}
+	return rcpts
+}
+
+// routeRecipients retrieves the recipients an alert in the given state should be
+// delivered to, or nil if the default recipients are used. If routes are set up
+// but none matches, the alert is delivered via the fallback route, reported by
+// the unrouted flag.
+func routeRecipients(routes []*stateRoute, fallback *fallbackRoute, state string) (tos []string, unrouted bool) {
+	for _, route := range routes {
+		if strings.EqualFold(route.State, state) {
+			return route.To, false
+		}
+	}
+	if len(routes) == 0 {
+		return nil, false
+	}
+	if fallback != nil && len(fallback.To) > 0 {
+		return fallback.To, true
+	}
+	return nil, true
+}
@@ -0,0 +1,90 @@
+// Copyright 2021 Péter Szilágyi. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// scheduleConfig is the active schedule of a recipient, e.g. the working hours of
+// a daytime support team. Outside of it, alerts are held back until the next
+// shift starts, or dropped.
+type scheduleConfig struct {
+	Days     []string `mapstructure:"days" json:"days,omitempty"`           // Weekdays the recipient is active on (mon, tue, ...), all if empty
+	From     string   `mapstructure:"from" json:"from"`                     // Start of the active hours, e.g. 09:00
+	To       string   `mapstructure:"to" json:"to"`                         // End of the active hours, e.g. 17:00
+	OffHours string   `mapstructure:"off-hours" json:"off-hours,omitempty"` // Policy outside the active hours: hold (default) or drop
+
+	days map[time.Weekday]bool // Parsed active weekdays
+	from int                   // Parsed start of the active hours, in minutes since midnight
+	to   int                   // Parsed end of the active hours, in minutes since midnight
+}
+
+// scheduleWeekdays maps the weekday names accepted in schedules to their values.
+var scheduleWeekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// validate checks the schedule for errors and parses it for evaluation.
+func (s *scheduleConfig) validate() error {
+	s.days = make(map[time.Weekday]bool)
+	for _, day := range s.Days {
+		weekday, ok := scheduleWeekdays[strings.ToLower(day)]
+		if !ok {
+			return fmt.Errorf("unknown weekday %q, want mon, tue, wed, thu, fri, sat or sun", day)
+		}
+		s.days[weekday] = true
+	}
+	var err error
+	if s.from, err = parseClock(s.From); err != nil {
+		return fmt.Errorf("invalid start time: %v", err)
+	}
+	if s.to, err = parseClock(s.To); err != nil {
+		return fmt.Errorf("invalid end time: %v", err)
+	}
+	if s.OffHours != "" && s.OffHours != "hold" && s.OffHours != "drop" {
+		return fmt.Errorf("unknown off-hours policy %q, want hold or drop", s.OffHours)
+	}
+	return nil
+}
+
+// parseClock parses a wall clock time in the form of 15:04 into minutes since
+// midnight.
+func parseClock(clock string) (int, error) {
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// active reports whether the schedule covers the given time, evaluated in the
+// configured timezone. Hours spanning midnight (e.g. 22:00 to 06:00) belong to
+// the day they start on. Equal start and end times cover the whole day.
+func (s *scheduleConfig) active(now time.Time) bool {
+	var (
+		local   = now.In(timeLocation)
+		minutes = local.Hour()*60 + local.Minute()
+		day     = local.Weekday()
+	)
+	if s.from == s.to {
+		return s.onDay(day)
+	}
+	if s.from < s.to {
+		return s.onDay(day) && minutes >= s.from && minutes < s.to
+	}
+	if minutes >= s.from {
+		return s.onDay(day)
+	}
+	return minutes < s.to && s.onDay((day+6)%7)
+}
+
+// onDay reports whether the schedule is active on a weekday.
+func (s *scheduleConfig) onDay(day time.Weekday) bool {
+	return len(s.days) == 0 || s.days[day]
+}
@@ -0,0 +1,47 @@
+// Copyright 2021 Péter Szilágyi. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// Tests that schedules are evaluated correctly for daytime hours, hours spanning
+// midnight and full days.
+func TestScheduleActive(t *testing.T) {
+	timeLocation = time.UTC
+
+	tests := []struct {
+		days     []string
+		from, to string
+		at       string // Sunday 2021-01-03 is the reference
+		active   bool
+	}{
+		{nil, "09:00", "17:00", "2021-01-04 08:59", false},
+		{nil, "09:00", "17:00", "2021-01-04 09:00", true},
+		{nil, "09:00", "17:00", "2021-01-04 17:00", false},
+		{[]string{"mon"}, "09:00", "17:00", "2021-01-05 10:00", false},
+		{[]string{"mon"}, "22:00", "06:00", "2021-01-04 23:00", true},
+		{[]string{"mon"}, "22:00", "06:00", "2021-01-05 05:59", true},
+		{[]string{"mon"}, "22:00", "06:00", "2021-01-04 05:59", false},
+		{nil, "00:00", "00:00", "2021-01-04 13:37", true},
+		{[]string{"mon"}, "08:00", "08:00", "2021-01-04 07:00", true},
+		{[]string{"mon"}, "08:00", "08:00", "2021-01-05 07:00", false},
+	}
+	for i, tt := range tests {
+		schedule := &scheduleConfig{Days: tt.days, From: tt.from, To: tt.to}
+		if err := schedule.validate(); err != nil {
+			t.Fatalf("test %d: failed to validate schedule: %v", i, err)
+		}
+		at, err := time.Parse("2006-01-02 15:04", tt.at)
+		if err != nil {
+			t.Fatalf("test %d: failed to parse time: %v", i, err)
+		}
+		if active := schedule.active(at); active != tt.active {
+			t.Errorf("test %d: activity mismatch at %s: have %v, want %v", i, tt.at, active, tt.active)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+// Copyright 2021 Péter Szilágyi. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/pflag"
+)
+
+// resolveSecrets replaces the values of the secret flags that point to another
+// source (`file:/path` or `env:VAR`) with the secret itself, so that secrets
+// can be kept out of the process arguments and mounted from secret stores.
+func resolveSecrets(flags *pflag.FlagSet) error {
+	for name := range secretFlags {
+		flag := flags.Lookup(name)
+		if flag == nil {
+			continue
+		}
+		secret, err := resolveSecret(flag.Value.String())
+		if err != nil {
+			return fmt.Errorf("--%s: %v", name, err)
+		}
+		// Set the value directly to retain if it came from a flag or not
+		if err := flag.Value.Set(secret); err != nil {
+			return fmt.Errorf("--%s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// resolveSecret dereferences a secret value if it points to a file (e.g. one
+// mounted by a container orchestrator or a Vault agent) or to an environment
+// variable. Any other value is considered the secret itself.
+func resolveSecret(value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, "file:"):
+		blob, err := os.ReadFile(strings.TrimPrefix(value, "file:"))
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(blob), "\r\n"), nil
+
+	case strings.HasPrefix(value, "env:"):
+		name := strings.TrimPrefix(value, "env:")
+		secret, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s not set", name)
+		}
+		return secret, nil
+
+	default:
+		return value, nil
+	}
+}
@@ -0,0 +1,37 @@
+// Copyright 2021 Péter Szilágyi. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import "strings"
+
+// severityConfig defines where the severity of an alert is read from and how the
+// raw values map to the severity levels understood by the forwarder (e.g. the
+// `critical` alerts exempt from expiry).
+type severityConfig struct {
+	Label  string            `mapstructure:"label" json:"label,omitempty"`
+	Values map[string]string `mapstructure:"values" json:"values,omitempty"`
+}
+
+// alertSeverity resolves the severity of an alert. The value extracted from the
+// payload takes precedence, falling back to the configured label (`severity` by
+// default). The raw value is then translated via the mapping table, if it has
+// an entry for it, or passed through as is otherwise.
+func alertSeverity(alert *receivedAlert, conf *severityConfig) string {
+	label := "severity"
+	if conf != nil && conf.Label != "" {
+		label = conf.Label
+	}
+	severity := alert.severity
+	if severity == "" {
+		severity = alert.labels[label]
+	}
+	if conf != nil {
+		// Config keys are case insensitive, so match the values likewise
+		if mapped, ok := conf.Values[strings.ToLower(severity)]; ok {
+			return mapped
+		}
+	}
+	return severity
+}
@@ -0,0 +1,26 @@
+// Copyright 2021 Péter Szilágyi. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// promoteHint tells the operator how a standby forwarder can be promoted.
+const promoteHint = "send SIGUSR1 to promote"
+
+// awaitPromoteSignal blocks until a promotion is requested via SIGUSR1,
+// reporting whether signal based promotions are supported at all.
+func awaitPromoteSignal() bool {
+	usr := make(chan os.Signal, 1)
+	signal.Notify(usr, syscall.SIGUSR1)
+	<-usr
+	signal.Stop(usr)
+	return true
+}
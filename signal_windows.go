@@ -0,0 +1,14 @@
+// Copyright 2021 Péter Szilágyi. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+// promoteHint tells the operator how a standby forwarder can be promoted.
+const promoteHint = "promote via POST /admin/promote"
+
+// awaitPromoteSignal would block until a promotion is requested via a signal,
+// but Windows has no SIGUSR1, so it reports that it's unsupported right away.
+func awaitPromoteSignal() bool {
+	return false
+}
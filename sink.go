@@ -0,0 +1,163 @@
+// Copyright 2021 Péter Szilágyi. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// sinkTimeout is the maximum time to wait for a webhook sink to accept an alert.
+const sinkTimeout = 5 * time.Second
+
+// sinkBacklog is the number of alerts buffered for a sink before new ones are
+// dropped, so a stalled sink doesn't pile up memory.
+const sinkBacklog = 256
+
+// sink is a secondary output the alerts are mirrored into besides Threema, e.g.
+// for testing the pipeline or for redundancy.
+type sink interface {
+	// send mirrors an alert into the sink.
+	send(alert *alert) error
+}
+
+// sinkRecord is the JSON representation of an alert mirrored into a sink.
+type sinkRecord struct {
+	Time       string   `json:"time"`
+	Recipients []string `json:"recipients,omitempty"`
+	Severity   string   `json:"severity,omitempty"`
+	Message    string   `json:"message"`
+	Images     int      `json:"images,omitempty"`
+}
+
+// newSinkRecord converts an alert into its JSON representation for the sinks.
+func newSinkRecord(alert *alert) *sinkRecord {
+	return &sinkRecord{
+		Time:       alert.queued.UTC().Format(time.RFC3339),
+		Recipients: alert.tos,
+		Severity:   alert.severity,
+		Message:    alert.message,
+		Images:     len(alert.images),
+	}
+}
+
+// writerSink mirrors alerts as JSON lines into an output stream.
+type writerSink struct {
+	out  io.Writer
+	lock sync.Mutex
+}
+
+// send implements sink, writing the alert as a single JSON line.
+func (s *writerSink) send(alert *alert) error {
+	blob, err := json.Marshal(newSinkRecord(alert))
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	_, err = s.out.Write(append(blob, '\n'))
+	return err
+}
+
+// webhookSink mirrors alerts by posting them as JSON to an HTTP endpoint.
+type webhookSink struct {
+	url    string
+	client *http.Client
+}
+
+// send implements sink, posting the alert to the webhook.
+func (s *webhookSink) send(alert *alert) error {
+	blob, err := json.Marshal(newSinkRecord(alert))
+	if err != nil {
+		return err
+	}
+	res, err := s.client.Post(s.url, "application/json", bytes.NewReader(blob))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("webhook sink rejected alert: %s", res.Status)
+	}
+	return nil
+}
+
+// asyncSink mirrors alerts into a sink from a background goroutine, so a slow
+// sink (e.g. a webhook timing out) doesn't hold up the Threema deliveries. If
+// the sink falls too far behind, new alerts are dropped instead of waited on.
+type asyncSink struct {
+	sink  sink
+	queue chan *alert
+}
+
+// newAsyncSink wraps a sink into an asynchronous one and starts feeding it.
+func newAsyncSink(sink sink) *asyncSink {
+	s := &asyncSink{
+		sink:  sink,
+		queue: make(chan *alert, sinkBacklog),
+	}
+	go s.loop()
+	return s
+}
+
+// send implements sink, queueing the alert for mirroring without blocking.
+func (s *asyncSink) send(alert *alert) error {
+	select {
+	case s.queue <- alert:
+		return nil
+	default:
+		return errors.New("sink backlog full, alert dropped")
+	}
+}
+
+// loop feeds the queued alerts into the wrapped sink.
+func (s *asyncSink) loop() {
+	for alert := range s.queue {
+		if err := s.sink.send(alert); err != nil {
+			log.Printf("Failed to mirror alert into sink: %v", err)
+		}
+	}
+}
+
+// newSinks creates the secondary sinks requested via the command line flags.
+// The file sink is rotated by size if a maximum size was configured.
+func newSinks(stdout bool, file string, webhook string) ([]sink, error) {
+	var sinks []sink
+	if stdout {
+		sinks = append(sinks, &writerSink{out: os.Stdout})
+	}
+	if file != "" && sinkFileMaxSizeFlag > 0 {
+		sinks = append(sinks, &writerSink{out: &lumberjack.Logger{
+			Filename:   file,
+			MaxSize:    sinkFileMaxSizeFlag,
+			MaxBackups: sinkFileMaxBackupsFlag,
+		}})
+	} else if file != "" {
+		out, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, &writerSink{out: out})
+	}
+	if webhook != "" {
+		sinks = append(sinks, &webhookSink{url: webhook, client: &http.Client{Timeout: sinkTimeout}})
+	}
+	for i, sink := range sinks {
+		sinks[i] = newAsyncSink(sink)
+	}
+	return sinks, nil
+}
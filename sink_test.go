@@ -0,0 +1,54 @@
+// Copyright 2021 Péter Szilágyi. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// blockingSink is a sink that hangs until released, recording what it got.
+type blockingSink struct {
+	release chan struct{}
+	got     chan *alert
+}
+
+func (s *blockingSink) send(alert *alert) error {
+	<-s.release
+	s.got <- alert
+	return nil
+}
+
+// Tests that a stalled sink doesn't block the sender, dropping alerts beyond the
+// backlog and delivering the buffered ones once it recovers.
+func TestAsyncSinkNonBlocking(t *testing.T) {
+	slow := &blockingSink{release: make(chan struct{}), got: make(chan *alert, 2*sinkBacklog)}
+	async := newAsyncSink(slow)
+
+	done := make(chan int)
+	go func() {
+		var failed int
+		for i := 0; i < 2*sinkBacklog; i++ {
+			if err := async.send(&alert{message: "test"}); err != nil {
+				failed++
+			}
+		}
+		done <- failed
+	}()
+	select {
+	case failed := <-done:
+		if failed == 0 {
+			t.Errorf("no alerts dropped beyond the backlog")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("sending into a stalled sink blocked")
+	}
+	close(slow.release)
+	select {
+	case <-slow.got:
+	case <-time.After(time.Second):
+		t.Fatalf("buffered alert not delivered after recovery")
+	}
+}
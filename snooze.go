@@ -0,0 +1,147 @@
+// Copyright 2021 Péter Szilágyi. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// snoozeCommand matches a reply requesting alerts to be snoozed for some time,
+	// optionally only the ones with a given fingerprint (prefix).
+	snoozeCommand = regexp.MustCompile(`^(?i)snooze\s+(\S+)(?:\s+([0-9a-f]{4,64}))?$`)
+
+	// unsnoozeCommand matches a reply requesting all snoozes to be lifted.
+	unsnoozeCommand = regexp.MustCompile(`^(?i)unsnooze$`)
+)
+
+// snooze is a request from a recipient to not be sent alerts for a while.
+type snooze struct {
+	until       time.Time // Time until which to suppress the alerts
+	fingerprint string    // Fingerprint prefix of the alerts to suppress, all if empty
+}
+
+// snoozes tracks the snoozed alerts of the recipients, nil if snoozing is not
+// enabled.
+var snoozes *snoozer
+
+// snoozer tracks the alerts the recipients asked not to be bothered with. Each
+// recipient's snoozes only affect the alerts sent to them, so the rest of the
+// on-call team still gets notified.
+type snoozer struct {
+	limit   time.Duration        // Maximum duration a snooze may be requested for
+	snoozes map[string][]*snooze // Active snoozes, keyed by recipient
+	replies chan *alert          // Confirmations to send back to the recipients
+	lock    sync.Mutex
+}
+
+// newSnoozer creates a snooze tracker without any active snoozes.
+func newSnoozer(limit time.Duration) *snoozer {
+	return &snoozer{
+		limit:   limit,
+		snoozes: make(map[string][]*snooze),
+		replies: make(chan *alert, 16),
+	}
+}
+
+// handle implements inboundAction, parsing snooze commands out of the received
+// messages and confirming them to the sender. Other messages are ignored.
+func (s *snoozer) handle(msg *inboundMessage) error {
+	text := strings.TrimSpace(msg.Text)
+
+	var reply string
+	if unsnoozeCommand.MatchString(text) {
+		s.lock.Lock()
+		delete(s.snoozes, msg.From)
+		s.lock.Unlock()
+
+		log.Printf("Recipient %s lifted their snoozes", msg.From)
+		reply = "Snoozes lifted, alerts resumed"
+	} else if match := snoozeCommand.FindStringSubmatch(text); match != nil {
+		duration, err := time.ParseDuration(match[1])
+		switch {
+		case err != nil || duration <= 0:
+			reply = fmt.Sprintf("Invalid snooze duration %q, try e.g. \"snooze 30m\"", match[1])
+		case duration > s.limit:
+			reply = fmt.Sprintf("Snooze duration %s above the limit of %s", formatDuration(duration), formatDuration(s.limit))
+		default:
+			until := time.Now().Add(duration)
+			prefix := strings.ToLower(match[2])
+
+			s.lock.Lock()
+			s.snoozes[msg.From] = append(s.snoozes[msg.From], &snooze{until: until, fingerprint: prefix})
+			s.lock.Unlock()
+
+			if prefix == "" {
+				log.Printf("Recipient %s snoozed all alerts for %s", msg.From, formatDuration(duration))
+				reply = fmt.Sprintf("Snoozed all alerts until %s", formatTime(until))
+			} else {
+				log.Printf("Recipient %s snoozed alert %s for %s", msg.From, prefix, formatDuration(duration))
+				reply = fmt.Sprintf("Snoozed alert %s until %s", prefix, formatTime(until))
+			}
+		}
+	} else {
+		return nil
+	}
+	select {
+	case s.replies <- &alert{message: reply, tos: []string{msg.From}, queued: time.Now()}:
+	default:
+		log.Printf("Dropping snooze confirmation to %s, too many pending", msg.From)
+	}
+	return nil
+}
+
+// snoozed reports whether an alert should be withheld from a recipient. Only
+// Grafana alerts can be snoozed, internal messages (e.g. heartbeats and snooze
+// confirmations) are always delivered. Expired snoozes are cleaned up.
+func (s *snoozer) snoozed(to string, alert *alert, now time.Time) bool {
+	if s == nil || alert.fingerprint == "" {
+		return false
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var (
+		active  []*snooze
+		snoozed bool
+	)
+	for _, snooze := range s.snoozes[to] {
+		if !now.Before(snooze.until) {
+			continue
+		}
+		active = append(active, snooze)
+		if strings.HasPrefix(alert.fingerprint, snooze.fingerprint) {
+			snoozed = true
+		}
+	}
+	if len(active) == 0 {
+		delete(s.snoozes, to)
+	} else {
+		s.snoozes[to] = active
+	}
+	return snoozed
+}
+
+// relay forwards the snooze confirmations into the publisher's alert queue until
+// the forwarder is shutting down.
+func (s *snoozer) relay(alerts chan *alert, quit chan struct{}) {
+	for {
+		select {
+		case reply := <-s.replies:
+			select {
+			case alerts <- reply:
+			case <-quit:
+				return
+			}
+		case <-quit:
+			return
+		}
+	}
+}
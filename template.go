@@ -0,0 +1,112 @@
+// Copyright 2021 Péter Szilágyi. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"text/template"
+	"time"
+)
+
+// messageTemplate is the custom template to render the Threema messages with,
+// or nil to use the built-in format. It's swapped atomically on reloads.
+var messageTemplate atomic.Pointer[template.Template]
+
+// testTemplate is the custom template to render test notifications with, or nil
+// to use the built-in test format. It's swapped atomically on reloads.
+var testTemplate atomic.Pointer[template.Template]
+
+// templateFuncs are the helper functions available to the message templates on
+// top of the Go template builtins.
+var templateFuncs = template.FuncMap{
+	"upper":            strings.ToUpper,
+	"lower":            strings.ToLower,
+	"truncate":         truncate,
+	"humanizeDuration": humanizeDuration,
+	"default":          defaultValue,
+	"markdownEscape":   markdownEscape,
+	"number":           func(value float64) string { return formatNumber(value, formatNumberFlag) },
+}
+
+// loadTemplate parses a custom message template from the given file.
+func loadTemplate(path string) (*template.Template, error) {
+	tmpl, err := template.New("message").Funcs(templateFuncs).ParseFiles(path)
+	if err != nil {
+		return nil, err
+	}
+	// ParseFiles names the template after the file, execute that one
+	return tmpl.Lookup(tmpl.Templates()[0].Name()), nil
+}
+
+// renderTemplate renders an alert with a custom message template.
+func renderTemplate(tmpl *template.Template, data *messageData) (string, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// truncate shortens a string to at most n characters, ending it with an ellipsis
+// if anything was cut off.
+func truncate(n int, s string) string {
+	runes := []rune(s)
+	if len(runes) <= n {
+		return s
+	}
+	if n <= 0 {
+		return ""
+	}
+	return string(runes[:n-1]) + "…"
+}
+
+// humanizeDuration renders a duration in a compact human readable form. Besides
+// proper durations, it accepts numbers as seconds and duration strings.
+func humanizeDuration(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case time.Duration:
+		return formatDuration(v), nil
+	case int:
+		return formatDuration(time.Duration(v) * time.Second), nil
+	case int64:
+		return formatDuration(time.Duration(v) * time.Second), nil
+	case float64:
+		return formatDuration(time.Duration(v * float64(time.Second))), nil
+	case string:
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return "", err
+		}
+		return formatDuration(d), nil
+	default:
+		return "", fmt.Errorf("unsupported duration type %T", value)
+	}
+}
+
+// defaultValue returns the fallback if the value is empty (zero), or the value
+// itself otherwise. It's meant to be used in pipelines: `{{ .X | default "-" }}`.
+func defaultValue(fallback interface{}, value interface{}) interface{} {
+	if value == nil {
+		return fallback
+	}
+	if v := reflect.ValueOf(value); v.IsZero() || ((v.Kind() == reflect.Map || v.Kind() == reflect.Slice) && v.Len() == 0) {
+		return fallback
+	}
+	return value
+}
+
+// markdownEscaper neutralizes the Threema text formatting markers by placing a
+// zero width space after them. Threema has no proper escape mechanism.
+var markdownEscaper = strings.NewReplacer("*", "*​", "_", "_​", "~", "~​")
+
+// markdownEscape neutralizes the Threema formatting markers (bold, italic and
+// strikethrough) in a string, so it's displayed verbatim.
+func markdownEscape(s string) string {
+	return markdownEscaper.Replace(s)
+}
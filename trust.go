@@ -0,0 +1,65 @@
+// Copyright 2021 Péter Szilágyi. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"github.com/karalabe/go-threema"
+)
+
+// lazyTrust adds the recipients as contacts on their first delivery, nil if
+// they were all trusted on startup.
+var lazyTrust *truster
+
+// truster adds recipients to the sender identity's contacts on demand, so that a
+// large recipient list doesn't delay startup, and a single bad recipient only
+// fails its own deliveries instead of aborting the forwarder.
+//
+// The truster is only ever used by the publisher, so it isn't thread safe.
+type truster struct {
+	id      *threema.Identity
+	pubkeys map[string]string // Configured pubkeys, empty if to be fetched
+	trusted map[string]bool   // Recipients already added as contacts
+}
+
+// newTruster creates a lazy truster for the given recipients and pubkeys.
+func newTruster(id *threema.Identity, pubkeys map[string]string) *truster {
+	return &truster{
+		id:      id,
+		pubkeys: pubkeys,
+		trusted: make(map[string]bool),
+	}
+}
+
+// untrusted reports whether a recipient was not yet added as a contact.
+func (t *truster) untrusted(to string) bool {
+	return t != nil && !t.trusted[to]
+}
+
+// trust adds a recipient as a contact unless already done, fetching its pubkey
+// from the Threema directory if none was configured. Failures aren't cached, so
+// the next delivery attempt tries again.
+//
+// Fetched pubkeys are only accepted over a verified TLS connection, otherwise a
+// forged directory response could substitute the key of any new recipient.
+//
+// The Threema library reads the contacts while connected, so the caller must
+// make sure there's no live connection while new recipients are trusted.
+func (t *truster) trust(to string) error {
+	if !t.untrusted(to) {
+		return nil
+	}
+	key := t.pubkeys[to]
+	if key == "" {
+		var err error
+		if key, err = lookupPubkey(to); err != nil {
+			return err
+		}
+	}
+	if err := t.id.Trust(to, key); err != nil {
+		return err
+	}
+	t.trusted[to] = true
+	return nil
+}
@@ -0,0 +1,130 @@
+// Copyright 2021 Péter Szilágyi. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// threemaIDPattern is the format of a Threema ID: eight uppercase letters or
+// digits, the first of which may be a `*` for gateway IDs.
+var threemaIDPattern = regexp.MustCompile(`^[A-Z0-9*][A-Z0-9]{7}$`)
+
+// newValidateCommand creates the `validate` command for checking the settings
+// before deploying them.
+func newValidateCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "validate",
+		Short: "Check the config file, template, identity and recipients without starting",
+		Run:   validate,
+	}
+}
+
+// validate loads and checks all the settings that can be verified offline,
+// reporting every problem found and exiting with a non-zero code if any.
+func validate(cmd *cobra.Command, args []string) {
+	var problems []string
+	report := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+	// Check the structured config and the message template
+	if configFileFlag != "" {
+		conf, err := readConfig(configFileFlag)
+		if err != nil {
+			report("config file: %v", err)
+		} else {
+			loadedConfig.Store(conf)
+		}
+	}
+	if formatTemplateFlag != "" {
+		tmpl, err := loadTemplate(formatTemplateFlag)
+		if err != nil {
+			report("message template: %v", err)
+		} else {
+			if _, err := renderTemplate(tmpl, sampleMessage()); err != nil {
+				report("message template: %v", err)
+			}
+		}
+	}
+	if formatTestFlag != "" {
+		tmpl, err := loadTemplate(formatTestFlag)
+		if err != nil {
+			report("test template: %v", err)
+		} else {
+			if _, err := renderTemplate(tmpl, sampleMessage()); err != nil {
+				report("test template: %v", err)
+			}
+		}
+	}
+	// Check that the identity can be decrypted, if one was given
+	if identityFlag != "" {
+		if _, err := loadIdentity(identityFlag, passwordFlag); err != nil {
+			report("identity: %v", err)
+		}
+	}
+	// Check that the recipients are well formed and paired up
+	var (
+		tos  = strings.Split(recipientIDFlag, ",")
+		keys = strings.Split(recipientPubKeyFlag, ",")
+	)
+	if recipientIDFlag == "" {
+		report("recipients: no recipient IDs provided")
+	} else {
+		if err := checkPairing(tos, keys, recipientFetchFlag); err != nil {
+			report("recipients: %v", err)
+		}
+		for _, to := range tos {
+			if !threemaIDPattern.MatchString(to) {
+				report("recipients: malformed Threema ID %q", to)
+			}
+		}
+		if recipientPubKeyFlag != "" {
+			for i, key := range keys {
+				if key == "" && recipientFetchFlag {
+					continue
+				}
+				if blob, err := base64.StdEncoding.DecodeString(key); err != nil || len(blob) != 32 {
+					report("recipients: malformed pubkey %d, want 32 base64 encoded bytes", i)
+				}
+			}
+		}
+		if err := validateRoutes(currentConfig().Routes, currentConfig().Fallback, tos); err != nil {
+			report("routes: %v", err)
+		}
+		if err := validateEscalations(currentConfig().Escalations, tos); err != nil {
+			report("escalations: %v", err)
+		}
+	}
+	// Report the outcome and exit accordingly
+	if len(problems) > 0 {
+		for _, problem := range problems {
+			fmt.Println("✗", problem)
+		}
+		os.Exit(exitConfig)
+	}
+	fmt.Println("✓ Configuration valid")
+}
+
+// sampleMessage creates a dummy alert to test render the message template with.
+func sampleMessage() *messageData {
+	return &messageData{
+		State:   "alerting",
+		Icon:    "🔥",
+		Title:   "Sample alert",
+		Message: "Sample alert message",
+		Matches: []*matchData{{Metric: "sample", Value: 42}},
+		Extras:  []*enrichment{{Name: "Owner", Value: "Sample team"}},
+		Link:    "http://localhost:3000",
+		Labels:  map[string]string{"severity": "critical"},
+
+		Fingerprint: "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08",
+	}
+}
@@ -0,0 +1,630 @@
+// Copyright 2021 Péter Szilágyi. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// errUnsupportedMediaType is returned if a webhook was posted with a content
+// type that the forwarder cannot parse.
+var errUnsupportedMediaType = errors.New("unsupported media type")
+
+// grafanaEvent is the notification payload sent by Grafana's webhook channel.
+// The other supported schemas are decoded into it too, before it's normalized
+// into a receivedAlert for the rest of the pipeline.
+type grafanaEvent struct {
+	RuleID   int64  `json:"ruleId"`
+	RuleName string `json:"ruleName"`
+	GroupKey string `json:"groupKey"`
+
+	State    string            `json:"state"`
+	Title    string            `json:"title"`
+	Message  string            `json:"message"`
+	Image    string            `json:"imageUrl"`
+	Images   []string          `json:"imageUrls"`
+	Link     string            `json:"ruleUrl"`
+	Severity string            `json:"-"` // Only set via field extraction
+	Tags     map[string]string `json:"tags"`
+	Labels   map[string]string `json:"commonLabels"`
+	Matches  []struct {
+		Metric string  `json:"metric"`
+		Value  float64 `json:"value"`
+	} `json:"evalMatches"`
+	Alerts []struct {
+		Image     string `json:"imageURL"`
+		Dashboard string `json:"dashboardURL"`
+		Panel     string `json:"panelURL"`
+	} `json:"alerts"`
+}
+
+// labels merges the legacy alert tags and the unified alerting common labels of
+// the event into a single label set.
+func (event *grafanaEvent) labels() map[string]string {
+	labels := make(map[string]string)
+	for key, value := range event.Tags {
+		labels[key] = value
+	}
+	for key, value := range event.Labels {
+		labels[key] = value
+	}
+	return labels
+}
+
+// imageSources gathers the images to attach to the alert: the legacy image URLs
+// and the screenshots of the unified alerting alerts. Newer Grafana versions
+// might not upload screenshots, only linking the dashboard or panel, in which
+// case the panel is rendered via Grafana's image renderer.
+func (event *grafanaEvent) imageSources(width int, height int) []*imageSource {
+	var (
+		sources []*imageSource
+		seen    = make(map[string]bool)
+	)
+	add := func(url string, render bool) {
+		if url != "" && !seen[url] {
+			seen[url] = true
+			sources = append(sources, &imageSource{url: url, render: render})
+		}
+	}
+	add(event.Image, false)
+	for _, url := range event.Images {
+		add(url, false)
+	}
+	for _, alert := range event.Alerts {
+		if alert.Image != "" {
+			add(alert.Image, false)
+			continue
+		}
+		for _, link := range []string{alert.Panel, alert.Dashboard} {
+			if link == "" {
+				continue
+			}
+			if url, err := panelRenderURL(link, width, height); err == nil {
+				add(url, true)
+				break
+			}
+		}
+	}
+	return sources
+}
+
+// decodeEvent parses a webhook request into a normalized alert. Besides the JSON
+// bodies sent by Grafana, form encoded bodies are also accepted for senders not
+// able to post raw JSON: either with the JSON in a `payload` field, or with the
+// known fields mapped directly to form fields.
+//
+// JSON payloads are parsed with the configured field extraction paths if any,
+// falling back to the built-in Grafana decoder otherwise.
+func decodeEvent(req *http.Request) (*receivedAlert, error) {
+	if err := decompressBody(req); err != nil {
+		return nil, err
+	}
+	defer req.Body.Close()
+
+	// If requested, log the raw body before decoding, to debug schema issues
+	if webhookLogBodyFlag {
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		var redact []string
+		if debugRedactFlag != "" {
+			redact = strings.Split(debugRedactFlag, ",")
+		}
+		logPayload(body, redact, webhookLogBodyMaxFlag)
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	kind := "application/json"
+	if header := req.Header.Get("Content-Type"); header != "" {
+		var err error
+		if kind, _, err = mime.ParseMediaType(header); err != nil {
+			return nil, err
+		}
+	}
+	event := new(grafanaEvent)
+	switch kind {
+	case "application/json":
+		blob, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		return parseEvent(blob)
+	case "application/x-www-form-urlencoded", "multipart/form-data":
+		if err := req.ParseMultipartForm(32 << 20); err != nil && err != http.ErrNotMultipart {
+			return nil, err
+		}
+		if payload := req.PostFormValue("payload"); payload != "" {
+			return parseEvent([]byte(payload))
+		}
+		event.State = req.PostFormValue("state")
+		event.Title = req.PostFormValue("title")
+		event.Message = req.PostFormValue("message")
+		event.Image = req.PostFormValue("imageUrl")
+		event.Link = req.PostFormValue("ruleUrl")
+		payload, _ := json.Marshal(req.PostForm)
+		return event.normalize(payload, time.Now()), nil
+	default:
+		return nil, fmt.Errorf("%w: %s", errUnsupportedMediaType, kind)
+	}
+}
+
+// decompressBody wraps the request body into a decompressing reader if it was
+// sent gzip or deflate encoded. The size of the body is limited after the
+// decompression, to avoid running out of memory on decompression bombs.
+func decompressBody(req *http.Request) error {
+	switch encoding := strings.ToLower(req.Header.Get("Content-Encoding")); encoding {
+	case "", "identity":
+	case "gzip", "x-gzip":
+		reader, err := gzip.NewReader(req.Body)
+		if err != nil {
+			return err
+		}
+		req.Body = reader
+	case "deflate":
+		// HTTP's deflate is zlib wrapped, but some senders use raw deflate
+		buffered := bufio.NewReader(req.Body)
+		if head, err := buffered.Peek(2); err == nil && (uint16(head[0])<<8|uint16(head[1]))%31 == 0 && head[0]&0x0f == 8 {
+			reader, err := zlib.NewReader(buffered)
+			if err != nil {
+				return err
+			}
+			req.Body = reader
+		} else {
+			req.Body = flate.NewReader(buffered)
+		}
+	default:
+		return fmt.Errorf("%w: encoding %s", errUnsupportedMediaType, encoding)
+	}
+	req.Body = http.MaxBytesReader(nil, req.Body, maxBodyFlag)
+	return nil
+}
+
+// parseEvent converts a raw JSON payload into a normalized alert, either via the
+// configured field extraction paths or renames, or via the built-in decoders for
+// Grafana OnCall and Grafana webhooks.
+func parseEvent(blob []byte) (*receivedAlert, error) {
+	var (
+		config = currentConfig()
+		event  = new(grafanaEvent)
+		err    error
+	)
+	if config.Extract != nil {
+		event, err = config.Extract.extract(blob)
+	} else if len(config.Fields) > 0 {
+		event, err = config.Fields.extract(blob)
+	} else if oncall, ok := parseOnCall(blob); ok {
+		event = oncall
+	} else {
+		decoder := json.NewDecoder(bytes.NewReader(blob))
+		if webhookStrictFlag {
+			decoder.DisallowUnknownFields()
+		}
+		err = decoder.Decode(event)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return event.normalize(blob, time.Now()), nil
+}
+
+// attachImages decides whether images should be downloaded and attached to an
+// alert. The global setting can be overridden per alert via a `threema_image`
+// label, e.g. to skip images for high frequency alerts.
+func attachImages(labels map[string]string, global bool) bool {
+	if value, ok := labels["threema_image"]; ok {
+		if attach, err := strconv.ParseBool(value); err == nil {
+			return attach
+		}
+	}
+	return global
+}
+
+// dropAlert responds to a webhook whose alert was deliberately not forwarded,
+// with the configured status code and a JSON body stating the reason. Senders
+// should not treat this as a failure, so the default status is 200 OK.
+func dropAlert(w http.ResponseWriter, reason string) {
+	countDropped(reason)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(droppedStatusFlag)
+	json.NewEncoder(w).Encode(map[string]string{"dropped": reason})
+}
+
+// setRetryAfter hints a sender when to retry a webhook that couldn't be accepted.
+// The hint is the configured base delay, scaled up to 4x as the alert queue is
+// backed up, so a backlog can drain before the retries pile on again. A zero
+// base delay omits the hint.
+func setRetryAfter(w http.ResponseWriter, base time.Duration, queued int, capacity int) {
+	if base <= 0 {
+		return
+	}
+	delay := base
+	if capacity > 0 {
+		delay += 3 * base * time.Duration(queued) / time.Duration(capacity)
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+}
+
+// limitInflight returns a middleware capping the number of webhooks handled
+// concurrently across all the wrapped handlers. Webhooks beyond the limit are
+// rejected straight away with 503 Service Unavailable instead of piling up
+// goroutines (and image downloads). A non-positive limit disables the cap.
+func limitInflight(limit int, retry time.Duration) func(http.HandlerFunc) http.HandlerFunc {
+	if limit <= 0 {
+		return func(next http.HandlerFunc) http.HandlerFunc { return next }
+	}
+	slots := make(chan struct{}, limit)
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, req *http.Request) {
+			select {
+			case slots <- struct{}{}:
+				defer func() { <-slots }()
+				next(w, req)
+			default:
+				atomic.AddUint64(&webhooksOverloaded, 1)
+				setRetryAfter(w, retry, 0, 0)
+				http.Error(w, "Too many webhooks in flight", http.StatusServiceUnavailable)
+			}
+		}
+	}
+}
+
+// isTestEvent reports whether an event is a test notification (e.g. sent via the
+// "Test" button of Grafana's notification channels), identified by the marker
+// appearing in its title or rule name.
+func isTestEvent(alert *receivedAlert, marker string) bool {
+	if marker == "" {
+		return false
+	}
+	return strings.Contains(alert.title, marker) || strings.Contains(alert.ruleName, marker)
+}
+
+// echoTest responds to a test notification with a description of what the
+// forwarder parsed from it and would have sent, instead of sending it.
+func echoTest(w http.ResponseWriter, data *messageData, message string, tos []string, images int) {
+	w.Header().Set("Content-Type", "application/json")
+
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(map[string]interface{}{
+		"test":        true,
+		"state":       data.State,
+		"title":       data.Title,
+		"recipients":  tos,
+		"message":     message,
+		"images":      images,
+		"imageErrors": data.ImageErrors,
+	})
+}
+
+// reservedPaths are the HTTP paths served by the forwarder itself, which cannot
+// be used to accept webhooks on.
+var reservedPaths = []string{"/metrics", "/healthz", "/readyz", "/admin/send", "/admin/promote"}
+
+// checkWebhookPath ensures a path is usable for accepting webhooks on.
+func checkWebhookPath(path string) error {
+	if !strings.HasPrefix(path, "/") {
+		return fmt.Errorf("path %q must start with a slash", path)
+	}
+	if contains(reservedPaths, path) {
+		return fmt.Errorf("path %s is reserved", path)
+	}
+	return nil
+}
+
+// trackHandlers wraps an HTTP handler, counting the requests being served in a
+// wait group, so a shutdown can wait for the ones outliving the server.
+func trackHandlers(running *sync.WaitGroup, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		running.Add(1)
+		defer running.Done()
+
+		next.ServeHTTP(w, req)
+	})
+}
+
+// exactPath wraps an HTTP handler so that it only serves the given path, not
+// the whole subtree below it, responding with 404 to anything else. This stops
+// probes (e.g. for /favicon.ico) from being treated as webhooks.
+func exactPath(path string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != path {
+			http.NotFound(w, req)
+			return
+		}
+		next(w, req)
+	}
+}
+
+// webhookHandler is the REST service that accepts Grafana webhook POSTs,
+// converts them into Threema messages and queues them for the publisher. The
+// stateful dependencies are injected, so the handler can be exercised without
+// the rest of the forwarder.
+type webhookHandler struct {
+	tos      []string                         // Recipients configured on the command line
+	debugTos []string                         // Recipients of the raw payload follow-ups, nil for all
+	queue    chan *alert                      // Publisher queue, only inspected to hint retries
+	enqueue  func(*http.Request, *alert) bool // Queues an alert for publishing, false if unavailable
+
+	dedup      *deduplicator    // Fingerprints of firing alerts, nil if not deduplicating
+	debounce   *deduplicator    // Hashes of recent webhook bodies, nil if not debouncing
+	enricher   *remoteEnricher  // Remote enrichment client, nil if not enriching
+	firings    *firingTracker   // Start times of firing alerts, nil if not collapsing resolutions
+	incidents  *incidentTracker // Incidents the alerts belong to, nil if not grouping
+	imageTypes []string         // Content types of images allowed to be attached
+}
+
+// ServeHTTP implements http.Handler, forwarding a single Grafana notification.
+func (h *webhookHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	// Pin the config for the whole request, it might get reloaded meanwhile
+	config := currentConfig()
+
+	// If the handling time is capped, abort image downloads and queueing when
+	// the deadline is hit. Images fetched until then are still attached.
+	if handlerTimeoutFlag > 0 {
+		ctx, cancel := context.WithTimeout(req.Context(), handlerTimeoutFlag)
+		defer cancel()
+		req = req.WithContext(ctx)
+	}
+	// Retrieve the alert from the Grafana notification
+	incoming, err := decodeEvent(req)
+	if err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, errUnsupportedMediaType) {
+			status = http.StatusUnsupportedMediaType
+		}
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			status = http.StatusRequestEntityTooLarge
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	// Collapse byte-identical webhooks delivered twice by Grafana's retries
+	if h.debounce != nil {
+		hash := sha256.Sum256(incoming.payload)
+		if !h.debounce.fire(hex.EncodeToString(hash[:]), time.Now()) {
+			log.Printf("Suppressing repeated webhook: %s", incoming.title)
+			dropAlert(w, "debounced")
+			return
+		}
+	}
+	// Suppress repeated fires of the same alert, clearing them on resolution
+	if h.dedup != nil {
+		switch incoming.state {
+		case "alerting":
+			if !h.dedup.fire(incoming.fingerprint, time.Now()) {
+				log.Printf("Suppressing duplicate alert: %s", incoming.title)
+				dropAlert(w, "duplicate")
+				return
+			}
+		case "ok":
+			h.dedup.resolve(incoming.fingerprint)
+		}
+	}
+
+	// If images were attached, try to download them, skipping failures
+	var (
+		images    [][]byte
+		imageErrs []error
+	)
+	sources := incoming.images
+	if !attachImages(incoming.labels, imageAttachFlag) {
+		sources = nil
+	}
+	if len(sources) > imageMaxCountFlag {
+		log.Printf("Dropping %d images above the attachment limit", len(sources)-imageMaxCountFlag)
+		sources = sources[:imageMaxCountFlag]
+	}
+	for _, source := range sources {
+		start := time.Now()
+		image, kind, err := downloadImage(req.Context(), source, imageRetriesFlag, imageRetryDelayFlag)
+		phaseImage.observe(time.Since(start))
+		debugf("Downloading image from %s took %v", source.url, time.Since(start))
+		if err != nil {
+			imageErrs = append(imageErrs, err)
+			continue
+		}
+		if reason := unexpectedImage(image, kind, h.imageTypes); reason != "" {
+			log.Printf("Skipping image from %s: %s", source.url, reason)
+			continue
+		}
+		image = convertImage(image, imageFormatFlag, imageQualityFlag)
+		if reason := uselessImage(image, imageMinBytesFlag, imageMaxBytesFlag); reason != "" {
+			log.Printf("Skipping image from %s: %s", source.url, reason)
+			continue
+		}
+		images = append(images, image)
+	}
+	// Prepare the alert message
+	var icon string
+	switch incoming.state {
+	case "alerting":
+		icon = "🔥"
+		if formatPlainFlag {
+			icon = "[ALERTING]"
+		}
+	case "ok":
+		icon = "☘️"
+		if formatPlainFlag {
+			icon = "[OK]"
+		}
+	case "acknowledged":
+		icon = "👀"
+		if formatPlainFlag {
+			icon = "[ACKNOWLEDGED]"
+		}
+	default:
+		icon = incoming.state
+		if formatPlainFlag {
+			icon = "[" + strings.ToUpper(incoming.state) + "]"
+		}
+	}
+	if formatStripPrefixFlag {
+		incoming.title = stripStatePrefix(incoming.title)
+	}
+	incoming.message = convertLinks(incoming.message, formatLinksFlag)
+	if formatMaxBodyFlag > 0 {
+		incoming.message = truncate(formatMaxBodyFlag, incoming.message)
+	}
+	// If there's only an image to show, caption it with something meaningful
+	if len(images) > 0 && imageCaptionFlag != "" && strings.TrimSpace(incoming.title) == "" && strings.TrimSpace(incoming.message) == "" {
+		incoming.title = imageCaptionFlag
+	}
+	// If incidents are tracked, tag the alert with the one it belongs to
+	var tag string
+	if h.incidents != nil {
+		key := incoming.groupKey
+		if incidentLabelFlag != "" {
+			key = incoming.labels[incidentLabelFlag]
+		}
+		if key != "" {
+			tag = h.incidents.tag(key, incoming.state == "ok") + " "
+		}
+	}
+	// Look up the extra context of the alert, carrying on without on failure
+	extras := enrich(incoming.labels, config.Enrich)
+	if remote, err := h.enricher.enrich(req.Context(), incoming.labels); err != nil {
+		log.Printf("Failed to enrich alert remotely: %v", err)
+	} else {
+		extras = append(extras, remote...)
+	}
+	data := &messageData{
+		State:       incoming.state,
+		Icon:        icon,
+		Tag:         tag,
+		Title:       incoming.title,
+		Message:     incoming.message,
+		Link:        incoming.link,
+		Labels:      incoming.labels,
+		Extras:      extras,
+		Fingerprint: incoming.fingerprint,
+	}
+	for _, err := range imageErrs {
+		data.ImageErrors = append(data.ImageErrors, err.Error())
+	}
+	data.Matches = incoming.matches
+	message := fitMessage(data, formatMaxBytesFlag)
+	if isTestEvent(incoming, webhookTestMarkerFlag) {
+		message = formatTest(data)
+	}
+
+	// If resolutions are collapsed, reduce them to a reference to the firing alert
+	if h.firings != nil {
+		switch incoming.state {
+		case "alerting":
+			h.firings.fire(incoming.fingerprint, incoming.received)
+		case "ok":
+			message, images = formatResolved(data, h.firings.resolve(incoming.fingerprint), incoming.received), nil
+		}
+	}
+	rcpts, unrouted := routeRecipients(config.Routes, config.Fallback, incoming.state)
+	if payloadRecipientsFlag {
+		if override := payloadRecipients(incoming.labels, h.tos, lazyTrust != nil); override != nil {
+			rcpts, unrouted = override, false
+		}
+	}
+
+	var key string
+	if coalesceFlag {
+		if key, err = coalesceKey(data, incoming.fingerprint); err != nil {
+			log.Printf("Failed to evaluate coalescing key: %v", err)
+		}
+	}
+	// If it's a test notification that should only be echoed, describe it
+	if webhookTestModeFlag == "echo" && isTestEvent(incoming, webhookTestMarkerFlag) {
+		log.Printf("Echoing test notification: %s", incoming.title)
+		if rcpts == nil {
+			rcpts = h.tos
+		}
+		echoTest(w, data, message, rcpts, len(images))
+		return
+	}
+	// Queue the message for Threema publishing
+	atomic.AddUint64(&alertsForwarded, 1)
+	atomic.AddUint64(&alertsReceived, 1)
+
+	queued := incoming.received
+	if rcpts != nil {
+		auditReceived("webhook", incoming.state, strings.TrimSpace(incoming.title), rcpts, queued)
+	} else {
+		auditReceived("webhook", incoming.state, strings.TrimSpace(incoming.title), h.tos, queued)
+	}
+	forwarded := &alert{
+		message:     message,
+		images:      images,
+		tos:         rcpts,
+		severity:    alertSeverity(incoming, config.Severity),
+		key:         key,
+		fingerprint: incoming.fingerprint,
+		state:       incoming.state,
+		queued:      queued,
+	}
+	if !h.enqueue(req, forwarded) {
+		setRetryAfter(w, webhookRetryAfterFlag, len(h.queue), cap(h.queue))
+		if errors.Is(req.Context().Err(), context.DeadlineExceeded) {
+			http.Error(w, "Handler timed out", http.StatusGatewayTimeout)
+			return
+		}
+		http.Error(w, "Publisher unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	// If acknowledgements are tracked, escalate the alert unless acked in time
+	if rcpts != nil {
+		escalations.track(forwarded, rcpts, incoming.state == "ok", config.Escalations)
+	} else {
+		escalations.track(forwarded, h.tos, incoming.state == "ok", config.Escalations)
+	}
+	// If the alert slipped through the routing rules, shout about it
+	if unrouted && config.Fallback != nil {
+		if config.Fallback.Warn {
+			log.Printf("WARNING: Alert in state %q matched no route, delivered via the fallback: %s", incoming.state, incoming.title)
+		}
+		if len(config.Fallback.Notify) > 0 {
+			h.enqueue(req, &alert{
+				message: "Alert in state " + incoming.state + " matched no route: " + strings.TrimSpace(incoming.title),
+				tos:     config.Fallback.Notify,
+				queued:  queued,
+			})
+		}
+	}
+	// If debugging was requested, follow up with the raw payload
+	if debugPayloadFlag {
+		var redact []string
+		if debugRedactFlag != "" {
+			redact = strings.Split(debugRedactFlag, ",")
+		}
+		followup := rcpts
+		if debugToFlag != "" {
+			followup = h.debugTos
+		}
+		h.enqueue(req, &alert{
+			message: debugPayload(incoming.payload, redact),
+			tos:     followup,
+			queued:  queued,
+		})
+	}
+}
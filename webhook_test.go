@@ -0,0 +1,288 @@
+// Copyright 2021 Péter Szilágyi. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/karalabe/go-threema"
+)
+
+// fakeSend is a single message recorded by the fake sender.
+type fakeSend struct {
+	to    string
+	text  string // Message text, or the caption of an image
+	image []byte // Image sent, nil for text messages
+}
+
+// fakeSender is a Threema backend recording the sends instead of delivering.
+type fakeSender struct {
+	lock  sync.Mutex
+	sends []*fakeSend
+}
+
+// SendText implements sender, recording a text message.
+func (s *fakeSender) SendText(to string, text string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.sends = append(s.sends, &fakeSend{to: to, text: text})
+	return nil
+}
+
+// SendImage implements sender, recording an image message.
+func (s *fakeSender) SendImage(to string, image []byte, caption string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.sends = append(s.sends, &fakeSend{to: to, text: caption, image: image})
+	return nil
+}
+
+// Close implements sender.
+func (s *fakeSender) Close() error { return nil }
+
+// testForwarder is a webhook handler wired to a running publisher, delivering
+// through a fake sender.
+type testForwarder struct {
+	handler *webhookHandler
+	server  *httptest.Server
+	sender  *fakeSender
+	alerts  chan *alert
+	done    chan struct{}
+}
+
+// setTestFlag overrides a command line flag for the duration of a test. The
+// flags are only registered when the forwarder is run, so they're all zero in
+// tests unless set.
+func setTestFlag[T any](t *testing.T, flag *T, value T) {
+	old := *flag
+	t.Cleanup(func() { *flag = old })
+	*flag = value
+}
+
+// newTestForwarder creates a webhook server for the given recipients, with the
+// publisher delivering into a fake sender.
+func newTestForwarder(t *testing.T, tos []string) *testForwarder {
+	t.Helper()
+
+	setTestFlag(t, &maxBodyFlag, 1024*1024)
+	setTestFlag(t, &droppedStatusFlag, http.StatusOK)
+	setTestFlag(t, &imageAttachFlag, true)
+	setTestFlag(t, &imageMaxCountFlag, 4)
+	setTestFlag(t, &imageMaxDownloadFlag, 1024*1024)
+
+	fake := new(fakeSender)
+
+	dial := dialer
+	t.Cleanup(func() { dialer = dial })
+	dialer = func(id *threema.Identity) (sender, chan struct{}, error) {
+		return fake, make(chan struct{}), nil
+	}
+	retries, err := newRetryQueue("")
+	if err != nil {
+		t.Fatalf("failed to create retry queue: %v", err)
+	}
+	fwd := &testForwarder{
+		sender: fake,
+		alerts: make(chan *alert, 16),
+		done:   make(chan struct{}),
+	}
+	fwd.handler = &webhookHandler{
+		tos:   tos,
+		queue: fwd.alerts,
+		enqueue: func(req *http.Request, alert *alert) bool {
+			select {
+			case fwd.alerts <- alert:
+				return true
+			default:
+				return false
+			}
+		},
+		imageTypes: []string{"image/png"},
+	}
+	fwd.server = httptest.NewServer(fwd.handler)
+	t.Cleanup(fwd.server.Close)
+
+	go func() {
+		defer close(fwd.done)
+		supervisePublisher(new(threema.Identity), tos, fwd.alerts, make(chan struct{}), retries, nil)
+	}()
+	return fwd
+}
+
+// post submits a webhook payload, returning the response status.
+func (fwd *testForwarder) post(t *testing.T, payload string) int {
+	t.Helper()
+
+	res, err := http.Post(fwd.server.URL, "application/json", strings.NewReader(payload))
+	if err != nil {
+		t.Fatalf("failed to post webhook: %v", err)
+	}
+	res.Body.Close()
+	return res.StatusCode
+}
+
+// flush closes the alert queue and waits for the publisher to deliver all the
+// queued alerts, returning the recorded sends.
+func (fwd *testForwarder) flush(t *testing.T) []*fakeSend {
+	t.Helper()
+
+	close(fwd.alerts)
+	select {
+	case <-fwd.done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("publisher didn't terminate")
+	}
+	fwd.sender.lock.Lock()
+	defer fwd.sender.lock.Unlock()
+
+	return fwd.sender.sends
+}
+
+// Tests that a Grafana alert posted to the webhook is delivered as a text message
+// to every configured recipient.
+func TestWebhookForwardsAlert(t *testing.T) {
+	fwd := newTestForwarder(t, []string{"ECHOECHO", "ABCDEFGH"})
+
+	if status := fwd.post(t, `{"state":"alerting","title":"[Alerting] CPU usage","message":"Load above 90%"}`); status != http.StatusOK {
+		t.Fatalf("status mismatch: have %d, want %d", status, http.StatusOK)
+	}
+	sends := fwd.flush(t)
+	if len(sends) != 2 {
+		t.Fatalf("send count mismatch: have %d, want 2", len(sends))
+	}
+	for i, to := range []string{"ECHOECHO", "ABCDEFGH"} {
+		if sends[i].to != to {
+			t.Errorf("send %d: recipient mismatch: have %s, want %s", i, sends[i].to, to)
+		}
+		if sends[i].image != nil {
+			t.Errorf("send %d: unexpected image", i)
+		}
+		if !strings.Contains(sends[i].text, "CPU usage") || !strings.Contains(sends[i].text, "Load above 90%") {
+			t.Errorf("send %d: message missing alert content: %q", i, sends[i].text)
+		}
+	}
+}
+
+// Tests that the image linked from an alert is downloaded and delivered as an
+// image message captioned with the alert text.
+func TestWebhookAttachesImage(t *testing.T) {
+	canvas := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	canvas.Set(0, 0, color.RGBA{R: 255, A: 255})
+
+	var blob bytes.Buffer
+	if err := png.Encode(&blob, canvas); err != nil {
+		t.Fatalf("failed to encode image: %v", err)
+	}
+	images := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(blob.Bytes())
+	}))
+	defer images.Close()
+
+	fwd := newTestForwarder(t, []string{"ECHOECHO"})
+	if status := fwd.post(t, `{"state":"alerting","title":"Disk full","imageUrl":"`+images.URL+`/panel.png"}`); status != http.StatusOK {
+		t.Fatalf("status mismatch: have %d, want %d", status, http.StatusOK)
+	}
+	sends := fwd.flush(t)
+	if len(sends) != 1 {
+		t.Fatalf("send count mismatch: have %d, want 1", len(sends))
+	}
+	if !bytes.Equal(sends[0].image, blob.Bytes()) {
+		t.Errorf("image mismatch: have %d bytes, want %d", len(sends[0].image), blob.Len())
+	}
+	if !strings.Contains(sends[0].text, "Disk full") {
+		t.Errorf("caption missing alert title: %q", sends[0].text)
+	}
+}
+
+// Tests that repeated fires of an alert are suppressed until it resolves, after
+// which a new fire is delivered again.
+func TestWebhookDeduplicates(t *testing.T) {
+	fwd := newTestForwarder(t, []string{"ECHOECHO"})
+	fwd.handler.dedup = newDeduplicator(time.Hour, 16)
+
+	for i, state := range []string{"alerting", "alerting", "ok", "alerting"} {
+		if status := fwd.post(t, `{"state":"`+state+`","ruleId":1,"title":"Disk full"}`); status != http.StatusOK {
+			t.Fatalf("post %d: status mismatch: have %d, want %d", i, status, http.StatusOK)
+		}
+	}
+	sends := fwd.flush(t)
+	if len(sends) != 3 {
+		t.Fatalf("send count mismatch: have %d, want 3", len(sends))
+	}
+	for i, icon := range []string{"🔥", "☘️", "🔥"} {
+		if !strings.Contains(sends[i].text, icon) {
+			t.Errorf("send %d: state icon %s missing: %q", i, icon, sends[i].text)
+		}
+	}
+}
+
+// Tests that malformed payloads are rejected without delivering anything.
+func TestWebhookRejectsMalformed(t *testing.T) {
+	fwd := newTestForwarder(t, []string{"ECHOECHO"})
+
+	if status := fwd.post(t, `{"state":`); status != http.StatusBadRequest {
+		t.Fatalf("status mismatch: have %d, want %d", status, http.StatusBadRequest)
+	}
+	if sends := fwd.flush(t); len(sends) != 0 {
+		t.Fatalf("send count mismatch: have %d, want 0", len(sends))
+	}
+}
+
+// Tests that an alert which can't be queued is answered with 503, so Grafana
+// retries it later.
+func TestWebhookUnavailable(t *testing.T) {
+	fwd := newTestForwarder(t, []string{"ECHOECHO"})
+	fwd.handler.enqueue = func(req *http.Request, alert *alert) bool { return false }
+
+	if status := fwd.post(t, `{"state":"alerting","title":"Disk full"}`); status != http.StatusServiceUnavailable {
+		t.Fatalf("status mismatch: have %d, want %d", status, http.StatusServiceUnavailable)
+	}
+	if sends := fwd.flush(t); len(sends) != 0 {
+		t.Fatalf("send count mismatch: have %d, want 0", len(sends))
+	}
+}
+
+// Tests that reloading the config switches the recipients over to the new pacing,
+// releasing the alerts held back by the old one.
+func TestWebhookReloadsPacing(t *testing.T) {
+	old := loadedConfig.Load()
+	t.Cleanup(func() { loadedConfig.Store(old) })
+
+	loadedConfig.Store(&fileConfig{Recipients: []*recipientConfig{{ID: "ECHOECHO", BatchWindow: time.Hour}}})
+	fwd := newTestForwarder(t, []string{"ECHOECHO"})
+
+	if status := fwd.post(t, `{"state":"alerting","title":"Disk full"}`); status != http.StatusOK {
+		t.Fatalf("status mismatch: have %d, want %d", status, http.StatusOK)
+	}
+	loadedConfig.Store(new(fileConfig))
+	if status := fwd.post(t, `{"state":"alerting","title":"CPU usage"}`); status != http.StatusOK {
+		t.Fatalf("status mismatch: have %d, want %d", status, http.StatusOK)
+	}
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		fwd.sender.lock.Lock()
+		sent := len(fwd.sender.sends)
+		fwd.sender.lock.Unlock()
+
+		if sent == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("send count mismatch: have %d, want 2", sent)
+		}
+	}
+	fwd.flush(t)
+}